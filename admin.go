@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+// NickServ accounts of nicks, "" for not logged in, learnt from
+// extended-join and account-notify. They are only ever trusted to turn
+// away non-admins early; admin commands are authorised by the account tag
+// or a fresh WHOIS.
+var (
+	accountsMu sync.Mutex
+	accounts   = make(map[string]string)
+)
+
+// Channels not posted to until the given time.
+var (
+	muteMu sync.Mutex
+	muted  = make(map[string]time.Time)
+)
+
+// trackAccounts follows extended-join JOINs and account-notify ACCOUNTs.
+// Nicks that part, are kicked, change or quit are forgotten, as whoever
+// uses the nick next may be someone else.
+func trackAccounts(m *irc.Message) {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+
+	switch m.Command {
+	case "JOIN":
+		// extended-join: <channel> <account> :<realname>
+		if len(m.Params) < 3 {
+			return
+		}
+		if m.Params[1] == "*" {
+			accounts[nickKey(m.Prefix.Name)] = ""
+		} else {
+			accounts[nickKey(m.Prefix.Name)] = m.Params[1]
+		}
+	case "ACCOUNT":
+		if len(m.Params) < 1 {
+			return
+		}
+		if m.Params[0] == "*" {
+			accounts[nickKey(m.Prefix.Name)] = ""
+		} else {
+			accounts[nickKey(m.Prefix.Name)] = m.Params[0]
+		}
+	case "KICK":
+		if len(m.Params) >= 2 {
+			delete(accounts, nickKey(m.Params[1]))
+		}
+	case "PART", "NICK", "QUIT":
+		delete(accounts, nickKey(m.Prefix.Name))
+	}
+}
+
+func resetAccounts() {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	accounts = make(map[string]string)
+}
+
+// senderAccount calls done with the NickServ account of whoever sent m,
+// or "" if they aren't logged in. With account-tag the tag tells, and a
+// message without one is from someone not logged in; otherwise it takes
+// a fresh WHOIS. Messages from Matrix carry the sender's user ID, which
+// the homeserver vouches for, as tag.
+func senderAccount(c *irc.Client, m *irc.Message, done func(account string)) {
+	if isMatrixTarget(m.Prefix.Name) || c.CapEnabled("account-tag") {
+		account, _ := m.Tags.GetTag("account")
+		done(account)
+		return
+	}
+	whoisAccount(c, m.Prefix.Name, done)
+}
+
+// knownNonAdmin reports whether extended-join and account-notify already
+// told us that nick isn't logged in to an admin account, so there is no
+// need to ask the server.
+func knownNonAdmin(c *irc.Client, nick string) bool {
+	if !c.CapEnabled("extended-join") || !c.CapEnabled("account-notify") {
+		return false
+	}
+	accountsMu.Lock()
+	account, ok := accounts[nickKey(nick)]
+	accountsMu.Unlock()
+	return ok && !adminAccount(account)
+}
+
+// adminMask reports whether p matches one of the configured admin masks.
+func adminMask(p *irc.Prefix) bool {
+	for _, re := range getConfig().adminMasks {
+		if re.MatchString(p.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+func adminAccount(account string) bool {
+	for _, a := range getConfig().AdminAccounts {
+		if account != "" && strings.EqualFold(a, account) {
+			return true
+		}
+	}
+	return false
+}
+
+// admin wraps an admin-only command: it is only run, and audited, for
+// senders matching an admin mask or logged in to an admin account.
+func admin(name string, f commandFunc) commandFunc {
+	return func(c *irc.Client, m *irc.Message, args []string) {
+		if adminMask(m.Prefix) {
+			audit(m.Prefix.String(), name, args, true)
+			f(c, m, args)
+			return
+		}
+		if knownNonAdmin(c, m.Prefix.Name) {
+			audit(m.Prefix.String(), name, args, false)
+			reply(c, m, "Only admins can do that")
+			return
+		}
+		senderAccount(c, m, func(account string) {
+			who := m.Prefix.String()
+			if account != "" {
+				who += " (" + account + ")"
+			}
+			if !adminAccount(account) {
+				audit(who, name, args, false)
+				reply(c, m, "Only admins can do that")
+				return
+			}
+			audit(who, name, args, true)
+			f(c, m, args)
+		})
+	}
+}
+
+// audit records who ran, or tried to run, an admin command, in the log
+// and in the configured audit log file.
+func audit(who, name string, args []string, allowed bool) {
+	result := "denied"
+	if allowed {
+		result = "allowed"
+	}
+	auditLog.Info("Admin command", "who", who, "command", name, "args", strings.Join(args, " "), "result", result)
+
+	path := getConfig().AuditLog
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		auditLog.Error("Cannot open audit log", "path", path, "err", err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s %s !%s %s\n", time.Now().Format(time.RFC3339), result, who, name, strings.Join(args, " "))
+}
+
+// isMuted reports whether target was muted by an admin.
+func isMuted(target string) bool {
+	muteMu.Lock()
+	defer muteMu.Unlock()
+	until, ok := muted[nickKey(target)]
+	if ok && time.Now().After(until) {
+		delete(muted, nickKey(target))
+		return false
+	}
+	return ok
+}
+
+// !join #channel
+func cmdJoin(c *irc.Client, m *irc.Message, args []string) {
+	if len(args) != 1 || !isChannelName(args[0]) {
+		reply(c, m, "Usage: !join #channel")
+		return
+	}
+	joinChannel(c, args[0])
+	reply(c, m, "Joining "+args[0])
+}
+
+// !part [#channel]
+func cmdPart(c *irc.Client, m *irc.Message, args []string) {
+	name := ""
+	switch {
+	case len(args) == 1 && isChannelName(args[0]):
+		name = args[0]
+	case len(args) == 0 && c.FromChannel(m) && isChannelName(m.Params[0]):
+		name = m.Params[0]
+	default:
+		reply(c, m, "Usage: !part [#channel]")
+		return
+	}
+	if !c.FromChannel(m) || nickKey(m.Params[0]) != nickKey(name) {
+		reply(c, m, "Leaving "+name)
+	}
+	leaveChannel(c, name, "Requested by "+m.Prefix.Name)
+}
+
+// !say <target> <text>
+func cmdSay(c *irc.Client, m *irc.Message, args []string) {
+	if len(args) < 2 {
+		reply(c, m, "Usage: !say <#channel|nick> <text>")
+		return
+	}
+	// Not say, so it gets through even where we are muted.
+	writeMessage(c, priorityReply, &irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{args[0], strings.Join(args[1:], " ")},
+	})
+}
+
+// !mute <#channel> <duration>, a duration of 0 unmutes.
+func cmdMute(c *irc.Client, m *irc.Message, args []string) {
+	if len(args) != 2 || !isChannelName(args[0]) {
+		reply(c, m, "Usage: !mute #channel <duration, like 2h, or 0 to unmute>")
+		return
+	}
+	d, err := time.ParseDuration(args[1])
+	if err != nil || d < 0 {
+		reply(c, m, "Bad duration "+args[1])
+		return
+	}
+
+	muteMu.Lock()
+	if d == 0 {
+		delete(muted, nickKey(args[0]))
+	} else {
+		muted[nickKey(args[0])] = time.Now().Add(d)
+	}
+	muteMu.Unlock()
+
+	if d == 0 {
+		reply(c, m, "Unmuted "+args[0])
+	} else {
+		reply(c, m, fmt.Sprintf("Muted %s for %v", args[0], d))
+	}
+}
+
+// !reload
+func cmdReload(c *irc.Client, m *irc.Message, args []string) {
+	cfg, err := reloadConfig()
+	if err != nil {
+		reply(c, m, err.Error())
+		return
+	}
+	reply(c, m, fmt.Sprintf("Reloaded, %d channels configured", len(cfg.Channels)))
+}
+
+// reloadConfig reads the -config file again and starts using it.
+func reloadConfig() (*Config, error) {
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load config: %v", err)
+	}
+	setConfig(cfg)
+	botLog.Info("Reloaded config", "path", *configFile)
+	return cfg, nil
+}
+
+// !rescan <from>
+func cmdRescan(c *irc.Client, m *irc.Message, args []string) {
+	if len(args) != 1 {
+		reply(c, m, "Usage: !rescan <PR number>")
+		return
+	}
+	from, err := strconv.Atoi(args[0])
+	if err != nil || from <= 0 {
+		reply(c, m, "Bad PR number "+args[0])
+		return
+	}
+	select {
+	case rescanFrom <- from:
+		reply(c, m, fmt.Sprintf("Looking for new PRs from %d", from))
+	default:
+		reply(c, m, "A rescan is already pending")
+	}
+}
+
+// !quit [message]
+func cmdQuit(c *irc.Client, m *irc.Message, args []string) {
+	if len(args) > 0 {
+		*quitMessage = strings.Join(args, " ")
+	}
+	botLog.Info("Quitting", "requested_by", m.Prefix.Name)
+	go shutdown()
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+const (
+	// After a failed JOIN, wait this long before trying again, doubling
+	// with every further failure up to maxRejoinDelay.
+	joinRetryDelay = time.Minute
+	// After being kicked, wait this long before rejoining, doubling when
+	// kicked again soon after. Every kickDecay without a kick halves the
+	// delay again.
+	kickRejoinDelay = 30 * time.Second
+	kickDecay       = time.Hour
+	maxRejoinDelay  = 30 * time.Minute
+	// How often channels we should be in but aren't are checked.
+	channelCheckInterval = 15 * time.Second
+)
+
+// JOIN failures, all with <me> <channel> :<reason>. 437 is also sent
+// for nicks, so only those about channels count.
+var joinErrors = map[string]bool{
+	irc.ERR_NOSUCHCHANNEL:   true,
+	irc.ERR_TOOMANYCHANNELS: true,
+	irc.ERR_UNAVAILRESOURCE: true,
+	irc.ERR_CHANNELISFULL:   true,
+	irc.ERR_INVITEONLYCHAN:  true,
+	irc.ERR_BANNEDFROMCHAN:  true,
+	irc.ERR_BADCHANNELKEY:   true,
+	irc.ERR_NOCHANMODES:     true, // or "need to be identified"
+}
+
+// channelStatus is where we are with one channel we want to be in.
+type channelStatus struct {
+	name     string
+	joined   bool
+	failures int
+	nextTry  time.Time
+}
+
+// kickRecord counts recent kicks from a channel. Unlike JOIN failures,
+// rejoining doesn't reset it, only time does.
+type kickRecord struct {
+	count int
+	last  time.Time
+}
+
+// Channels of the current connection, by nickKey. extraChannels are ones
+// we were invited to or told to join, in addition to the configured ones,
+// and partedChannels configured ones we were told to leave. kicks outlive
+// connections.
+var (
+	chanMu         sync.Mutex
+	chanStatus     = make(map[string]*channelStatus)
+	extraChannels  = make(map[string]string)
+	partedChannels = make(map[string]bool)
+	kicks          = make(map[string]*kickRecord)
+	joinsAllowed   bool
+)
+
+// desiredChannels are all the channels we should be in.
+func desiredChannels() []string {
+	chanMu.Lock()
+	defer chanMu.Unlock()
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range getConfig().joinChannels() {
+		if isMatrixTarget(name) {
+			continue
+		}
+		if !partedChannels[nickKey(name)] {
+			names = append(names, name)
+		}
+		seen[nickKey(name)] = true
+	}
+	for key, name := range extraChannels {
+		if !seen[key] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func channelKey(name string) string {
+	if ch := findChannel(name); ch != nil {
+		return ch.Key
+	}
+	return ""
+}
+
+func sendJoin(c *irc.Client, name string) {
+	params := []string{name}
+	if key := channelKey(name); key != "" {
+		params = append(params, key)
+	}
+	writeMessage(c, priorityProtocol, &irc.Message{
+		Command: "JOIN",
+		Params:  params,
+	})
+}
+
+// statusLocked returns the status of name, creating it if needed. The
+// caller must hold chanMu.
+func statusLocked(name string) *channelStatus {
+	st, ok := chanStatus[nickKey(name)]
+	if !ok {
+		st = &channelStatus{name: name}
+		chanStatus[nickKey(name)] = st
+	}
+	return st
+}
+
+// joinAll joins every channel we should be in, and from now on keeps
+// trying to stay in them.
+func joinAll(c *irc.Client) {
+	chanMu.Lock()
+	joinsAllowed = true
+	chanMu.Unlock()
+
+	for _, name := range desiredChannels() {
+		chanMu.Lock()
+		statusLocked(name).nextTry = time.Now().Add(joinRetryDelay)
+		chanMu.Unlock()
+		sendJoin(c, name)
+		ircLog.Info("Joining", "channel", name)
+	}
+}
+
+// joinChannel adds name to the channels we stay in and joins it.
+func joinChannel(c *irc.Client, name string) {
+	chanMu.Lock()
+	extraChannels[nickKey(name)] = name
+	delete(partedChannels, nickKey(name))
+	statusLocked(name).nextTry = time.Time{}
+	chanMu.Unlock()
+
+	sendJoin(c, name)
+}
+
+// leaveChannel leaves name and stops rejoining it.
+func leaveChannel(c *irc.Client, name, reason string) {
+	chanMu.Lock()
+	delete(extraChannels, nickKey(name))
+	delete(chanStatus, nickKey(name))
+	partedChannels[nickKey(name)] = true
+	chanMu.Unlock()
+
+	writeMessage(c, priorityProtocol, &irc.Message{
+		Command: "PART",
+		Params:  []string{name, reason},
+	})
+}
+
+// backoff is how long to wait after the given number of failures.
+func backoff(base time.Duration, failures int) time.Duration {
+	d := base
+	for i := 1; i < failures && d < maxRejoinDelay; i++ {
+		d *= 2
+	}
+	if d > maxRejoinDelay {
+		d = maxRejoinDelay
+	}
+	return d
+}
+
+// kickedLocked counts a kick from name at now and returns how long to wait
+// before rejoining. The caller must hold chanMu.
+func kickedLocked(name string, now time.Time) time.Duration {
+	k, ok := kicks[nickKey(name)]
+	if !ok {
+		k = &kickRecord{}
+		kicks[nickKey(name)] = k
+	}
+	if k.count > 0 {
+		k.count -= int(now.Sub(k.last) / kickDecay)
+		if k.count < 0 {
+			k.count = 0
+		}
+	}
+	k.count++
+	k.last = now
+	return backoff(kickRejoinDelay, k.count)
+}
+
+// trackChannels follows our own JOINs, PARTs and KICKs, failed joins and
+// invitations.
+func trackChannels(c *irc.Client, m *irc.Message) {
+	self := func(nick string) bool {
+		return nickKey(nick) == nickKey(ownNick())
+	}
+
+	switch {
+	case m.Command == "JOIN" && self(m.Prefix.Name) && len(m.Params) > 0:
+		chanMu.Lock()
+		st := statusLocked(m.Params[0])
+		st.joined = true
+		st.failures = 0
+		chanMu.Unlock()
+		ircLog.Info("Joined", "channel", m.Params[0])
+
+	case m.Command == "PART" && self(m.Prefix.Name) && len(m.Params) > 0:
+		chanMu.Lock()
+		if st, ok := chanStatus[nickKey(m.Params[0])]; ok {
+			// Forced to leave by services or an oper.
+			st.joined = false
+			st.nextTry = time.Now().Add(kickRejoinDelay)
+		}
+		chanMu.Unlock()
+
+	case m.Command == "KICK" && len(m.Params) > 1 && self(m.Params[1]):
+		chanMu.Lock()
+		st := statusLocked(m.Params[0])
+		st.joined = false
+		delay := kickedLocked(m.Params[0], time.Now())
+		st.nextTry = time.Now().Add(delay)
+		chanMu.Unlock()
+		ircLog.Warn("Kicked", "channel", m.Params[0], "by", m.Prefix.Name,
+			"reason", chatText(m.Trailing()), "rejoin_in", delay)
+
+	case joinErrors[m.Command] && len(m.Params) > 2 && isChannelName(m.Params[1]):
+		chanMu.Lock()
+		st := statusLocked(m.Params[1])
+		st.joined = false
+		st.failures++
+		delay := backoff(joinRetryDelay, st.failures)
+		st.nextTry = time.Now().Add(delay)
+		chanMu.Unlock()
+		ircLog.Warn("Cannot join", "channel", m.Params[1], "numeric", m.Command, "reason", m.Trailing(), "retry_in", delay)
+
+	case m.Command == "INVITE" && len(m.Params) > 1:
+		if !inviteAllowed(m.Prefix) {
+			ircLog.Info("Ignoring invite", "channel", m.Params[1], "from", m.Prefix)
+			return
+		}
+		ircLog.Info("Invited", "channel", m.Params[1], "by", m.Prefix)
+		joinChannel(c, m.Params[1])
+	}
+}
+
+// inviteAllowed reports whether invites from p are accepted.
+func inviteAllowed(p *irc.Prefix) bool {
+	for _, re := range getConfig().inviteAllow {
+		if re.MatchString(p.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// runChannelMaintenance rejoins channels we should be in but aren't, once
+// their retry delay is over.
+func runChannelMaintenance() {
+	for sleep(channelCheckInterval) {
+		c := currentClient()
+		if c == nil {
+			continue
+		}
+
+		now := time.Now()
+		var retry []string
+		chanMu.Lock()
+		allowed := joinsAllowed
+		chanMu.Unlock()
+		if !allowed {
+			continue
+		}
+		for _, name := range desiredChannels() {
+			chanMu.Lock()
+			st := statusLocked(name)
+			if !st.joined && now.After(st.nextTry) {
+				// Don't send another JOIN before this one is answered.
+				st.nextTry = now.Add(backoff(joinRetryDelay, st.failures+1))
+				retry = append(retry, name)
+			}
+			chanMu.Unlock()
+		}
+		for _, name := range retry {
+			ircLog.Info("Rejoining", "channel", name)
+			sendJoin(c, name)
+		}
+	}
+}
+
+// joinedChannels returns the channels we are in.
+func joinedChannels() []string {
+	chanMu.Lock()
+	defer chanMu.Unlock()
+
+	var names []string
+	for _, st := range chanStatus {
+		if st.joined {
+			names = append(names, st.name)
+		}
+	}
+	return names
+}
+
+// resetChannels forgets what we had joined, for when we are disconnected.
+func resetChannels() {
+	chanMu.Lock()
+	defer chanMu.Unlock()
+	chanStatus = make(map[string]*channelStatus)
+	joinsAllowed = false
+}
+
+// isChannelName reports whether name looks like an IRC channel.
+func isChannelName(name string) bool {
+	return name != "" && strings.ContainsRune("#&+!", rune(name[0])) && !isMatrixTarget(name)
+}
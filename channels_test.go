@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKickBackoff(t *testing.T) {
+	defer func() {
+		chanMu.Lock()
+		kicks = make(map[string]*kickRecord)
+		chanMu.Unlock()
+	}()
+
+	start := time.Date(2020, 3, 4, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		channel string
+		at      time.Duration
+		delay   time.Duration
+	}{
+		{"#netbsd", 0, 30 * time.Second},
+		// Kicked again after rejoining: rejoining doesn't reset it.
+		{"#NetBSD", time.Minute, time.Minute},
+		{"#netbsd", 2 * time.Minute, 2 * time.Minute},
+		{"#netbsd-bugs", 2 * time.Minute, 30 * time.Second},
+		// An hour of peace takes one step back.
+		{"#netbsd", 62 * time.Minute, 2 * time.Minute},
+		// Several take several.
+		{"#netbsd", 5 * time.Hour, 30 * time.Second},
+		{"#netbsd", 5*time.Hour + time.Minute, time.Minute},
+	}
+	for i, step := range steps {
+		chanMu.Lock()
+		delay := kickedLocked(step.channel, start.Add(step.at))
+		chanMu.Unlock()
+		if delay != step.delay {
+			t.Errorf("step %d, kicked from %s at %v: delay %v, want %v", i, step.channel, step.at, delay, step.delay)
+		}
+	}
+
+	for failures, want := range []time.Duration{
+		joinRetryDelay, joinRetryDelay, 2 * joinRetryDelay, 4 * joinRetryDelay,
+		8 * joinRetryDelay, 16 * joinRetryDelay, maxRejoinDelay, maxRejoinDelay,
+	} {
+		if got := backoff(joinRetryDelay, failures); got != want {
+			t.Errorf("backoff(%v, %d) = %v, want %v", joinRetryDelay, failures, got, want)
+		}
+	}
+}
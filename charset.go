@@ -0,0 +1,177 @@
+package main
+
+import (
+	"mime"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// How far into a page we look for a <meta> charset declaration.
+const metaCharsetWindow = 1024
+
+var metaCharsetRegexp = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?([a-z0-9_.:-]+)`)
+
+// windows1252High maps bytes 0x80-0x9f of windows-1252. Bytes it leaves
+// undefined map to the C1 control of the same value, like browsers do.
+var windows1252High = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+}
+
+// Where iso-8859-15 differs from iso-8859-1.
+var iso885915 = map[byte]rune{
+	0xa4: '€',
+	0xa6: 'Š',
+	0xa8: 'š',
+	0xb4: 'Ž',
+	0xb8: 'ž',
+	0xbc: 'Œ',
+	0xbd: 'œ',
+	0xbe: 'Ÿ',
+}
+
+// charsetLabels maps the labels of the charsets we decode, as in the
+// WHATWG Encoding Standard, to their names.
+var charsetLabels = map[string]string{
+	"utf-8":             "utf-8",
+	"utf8":              "utf-8",
+	"unicode-1-1-utf-8": "utf-8",
+
+	"iso-8859-15": "iso-8859-15",
+	"iso8859-15":  "iso-8859-15",
+	"iso885915":   "iso-8859-15",
+	"iso_8859-15": "iso-8859-15",
+	"csisolatin9": "iso-8859-15",
+	"latin-9":     "iso-8859-15",
+	"latin9":      "iso-8859-15",
+	"l9":          "iso-8859-15",
+
+	// As in browsers, latin1 and ascii are read as their windows-1252
+	// superset.
+	"windows-1252":    "windows-1252",
+	"windows1252":     "windows-1252",
+	"cp1252":          "windows-1252",
+	"x-cp1252":        "windows-1252",
+	"iso-8859-1":      "windows-1252",
+	"iso8859-1":       "windows-1252",
+	"iso88591":        "windows-1252",
+	"iso_8859-1":      "windows-1252",
+	"iso_8859-1:1987": "windows-1252",
+	"iso-ir-100":      "windows-1252",
+	"csisolatin1":     "windows-1252",
+	"latin1":          "windows-1252",
+	"latin-1":         "windows-1252",
+	"l1":              "windows-1252",
+	"cp819":           "windows-1252",
+	"ibm819":          "windows-1252",
+	"us-ascii":        "windows-1252",
+	"ascii":           "windows-1252",
+	"ansi_x3.4-1968":  "windows-1252",
+	"iso646-us":       "windows-1252",
+}
+
+// Charsets we were asked to decode but can't, logged once each.
+var (
+	unknownCharsetsMu sync.Mutex
+	unknownCharsets   = make(map[string]bool)
+)
+
+// charsetName is the name of the charset label stands for, "" if we
+// don't know it.
+func charsetName(label string) string {
+	label = strings.ToLower(strings.Trim(label, " \t\"'"))
+	if label == "" {
+		return ""
+	}
+	if name, ok := charsetLabels[label]; ok {
+		return name
+	}
+
+	unknownCharsetsMu.Lock()
+	first := !unknownCharsets[label]
+	unknownCharsets[label] = true
+	unknownCharsetsMu.Unlock()
+	if first {
+		gnatsLog.Warn("Unknown charset, reading as UTF-8", "charset", label)
+	}
+	return ""
+}
+
+// pageCharset finds the charset of a page from its Content-Type header,
+// then from a <meta> tag near the start. It returns "" if neither says.
+func pageCharset(contentType string, body []byte) string {
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if cs := params["charset"]; cs != "" {
+			return strings.ToLower(cs)
+		}
+	}
+
+	head := body
+	if len(head) > metaCharsetWindow {
+		head = head[:metaCharsetWindow]
+	}
+	if rs := metaCharsetRegexp.FindSubmatch(head); rs != nil {
+		return strings.ToLower(string(rs[1]))
+	}
+	return ""
+}
+
+// toUTF8 converts a page to UTF-8. Old PRs were submitted in whatever
+// the submitter's mail client used, so bytes that aren't valid in the
+// declared charset are taken to be windows-1252, the usual culprit.
+func toUTF8(contentType string, body []byte) string {
+	switch charsetName(pageCharset(contentType, body)) {
+	case "iso-8859-15":
+		return decodeSingleByte(body, func(b byte) rune {
+			if r, ok := iso885915[b]; ok {
+				return r
+			}
+			return rune(b)
+		})
+	case "windows-1252":
+		return decodeSingleByte(body, windows1252Rune)
+	default:
+		return decodeUTF8Fallback(body)
+	}
+}
+
+func windows1252Rune(b byte) rune {
+	if b >= 0x80 && b < 0xa0 {
+		return windows1252High[b-0x80]
+	}
+	return rune(b)
+}
+
+func decodeSingleByte(body []byte, decode func(byte) rune) string {
+	var sb strings.Builder
+	sb.Grow(len(body))
+	for _, b := range body {
+		sb.WriteRune(decode(b))
+	}
+	return sb.String()
+}
+
+// decodeUTF8Fallback decodes UTF-8, reading invalid bytes as windows-1252.
+func decodeUTF8Fallback(body []byte) string {
+	if utf8.Valid(body) {
+		return string(body)
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(body))
+	for len(body) > 0 {
+		r, size := utf8.DecodeRune(body)
+		if r == utf8.RuneError && size <= 1 {
+			sb.WriteRune(windows1252Rune(body[0]))
+			body = body[1:]
+			continue
+		}
+		sb.WriteRune(r)
+		body = body[size:]
+	}
+	return sb.String()
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestToUTF8(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{"text/html; charset=utf-8", "caf\xc3\xa9", "café"},
+		{"text/html; charset=UTF8", "caf\xc3\xa9", "café"},
+		{"text/html; charset=\"utf-8\"", "caf\xc3\xa9", "café"},
+		// Bytes that are valid UTF-8 tell the declared charset from
+		// the fallback for unknown ones.
+		{"text/html; charset=iso-8859-1", "caf\xe9 \x80 \xc3\xa9", "café € Ã©"},
+		{"text/html; charset=ISO_8859-1", "\xc3\xa9", "Ã©"},
+		{"text/html; charset=iso8859-1", "\xc3\xa9", "Ã©"},
+		{"text/html; charset=Latin-1", "\xc3\xa9", "Ã©"},
+		{"text/html; charset=windows1252", "\xc3\xa9", "Ã©"},
+		{"text/html; charset=x-cp1252", "\x93quoted\x94 \xc3\xa9", "“quoted” Ã©"},
+		{"text/html; charset=us-ascii", "\xc3\xa9", "Ã©"},
+		{"text/html; charset=ISO-8859-15", "\xa4 \xbd", "€ œ"},
+		{"text/html; charset=l9", "\xa4", "€"},
+		{"text/html", "<meta charset='latin1'>\xc3\xa9", "<meta charset='latin1'>Ã©"},
+		// No charset or an unknown one is read as UTF-8, falling back
+		// to windows-1252 for invalid bytes.
+		{"text/html", "caf\xc3\xa9 caf\xe9", "café café"},
+		{"text/html; charset=koi8-r", "caf\xe9", "café"},
+	}
+	for _, test := range tests {
+		if got := toUTF8(test.contentType, []byte(test.body)); got != test.want {
+			t.Errorf("toUTF8(%q, %q) = %q, want %q", test.contentType, test.body, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// subcommands run instead of the bot, as "gnatsirc <name> args...".
+var subcommands map[string]func(args []string)
+
+func init() {
+	subcommands = map[string]func(args []string){
+		"ctl":     runCtl,
+		"lookup":  runLookup,
+		"scan":    runScan,
+		"head":    runHead,
+		"export":  runExport,
+		"console": runConsole,
+	}
+}
+
+// How a PR number turned out in a scan.
+const (
+	scanExists       = "exists"
+	scanConfidential = "confidential"
+	scanMissing      = "missing"
+	scanError        = "error"
+)
+
+func exitf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+// prRangeFlags adds -from and -to to fs.
+func prRangeFlags(fs *flag.FlagSet) (from, to *int) {
+	from = fs.Int("from", 0, "First PR number")
+	to = fs.Int("to", 0, "Last PR number, the same as -from if not given")
+	return from, to
+}
+
+func checkRange(fs *flag.FlagSet, from, to *int) {
+	if *to == 0 {
+		*to = *from
+	}
+	if *from <= 0 || *to < *from {
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// exportedPR is a PR as written by lookup -json and export.
+type exportedPR struct {
+	*PR
+	URL         string `json:"url"`
+	Description string `json:"description"`
+}
+
+func exported(pr *PR) exportedPR {
+	return exportedPR{PR: pr, URL: toGnatsUrl(pr.Number), Description: pr.Description}
+}
+
+// gnatsirc lookup [-json] <PR number>...
+func runLookup(args []string) {
+	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the PRs as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s lookup [-json] <PR number>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for i, arg := range fs.Args() {
+		num, err := strconv.Atoi(arg)
+		if err != nil {
+			exitf("Bad PR number %q", arg)
+		}
+		pr, err := fetchPR(num)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "PR %d: %v\n", num, err)
+			failed = true
+			continue
+		}
+
+		if *asJSON {
+			out, _ := json.MarshalIndent(exported(pr), "", "  ")
+			fmt.Println(string(out))
+			continue
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("PR %d: %s\n", pr.Number, pr.Synopsis)
+		fmt.Printf("Category:      %s\n", pr.Category)
+		fmt.Printf("State:         %s\n", pr.State)
+		fmt.Printf("Severity:      %s\n", pr.Severity)
+		fmt.Printf("Responsible:   %s\n", pr.Responsible)
+		if !pr.LastModified.IsZero() {
+			fmt.Printf("Last-Modified: %s\n", pr.LastModified.Format(time.RFC1123Z))
+		}
+		fmt.Printf("URL:           %s\n", toGnatsUrl(pr.Number))
+		if pr.Description != "" {
+			fmt.Printf("\n%s\n", pr.Description)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// scanResult is one PR number looked at by a scan.
+type scanResult struct {
+	number int
+	status string
+	pr     *PR
+	err    error
+}
+
+// scanPRs fetches every PR from from to to. Confidential and missing PRs
+// look the same, but as PRs are numbered in order, those below an existing
+// one can only be confidential.
+func scanPRs(from, to int) []scanResult {
+	var results []scanResult
+	lastExisting := -1
+	for num := from; num <= to; num++ {
+		pr, err := fetchPR(num)
+		r := scanResult{number: num, pr: pr, err: err}
+		switch {
+		case err == nil:
+			r.status = scanExists
+			lastExisting = len(results)
+		case err == errNoSuchPR:
+			r.status = scanMissing
+		default:
+			r.status = scanError
+		}
+		results = append(results, r)
+	}
+	for i := 0; i < lastExisting; i++ {
+		if results[i].status == scanMissing {
+			results[i].status = scanConfidential
+		}
+	}
+	return results
+}
+
+// gnatsirc scan -from N -to M
+func runScan(args []string) {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	from, to := prRangeFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s scan -from N [-to M]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	checkRange(fs, from, to)
+
+	counts := make(map[string]int)
+	for _, r := range scanPRs(*from, *to) {
+		counts[r.status]++
+		switch r.status {
+		case scanExists:
+			fmt.Printf("%d\t%s\t%s\t%s\n", r.number, r.status, r.pr.Category, r.pr.Synopsis)
+		case scanError:
+			fmt.Printf("%d\t%s\t%v\n", r.number, r.status, r.err)
+		default:
+			fmt.Printf("%d\t%s\n", r.number, r.status)
+		}
+	}
+	fmt.Printf("%d existing, %d confidential, %d missing, %d errors\n",
+		counts[scanExists], counts[scanConfidential], counts[scanMissing], counts[scanError])
+}
+
+// gnatsirc head
+func runHead(args []string) {
+	fs := flag.NewFlagSet("head", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s head\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	fmt.Println(findLatestGoodPR())
+}
+
+// gnatsirc export -format json|csv|mbox -from N -to M
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "json", "Output format: json, csv or mbox")
+	domain := fs.String("mail-domain", "", "Domain of the Message-IDs of -format mbox. Use the domain of the bot's email from address to thread them with its mails")
+	from, to := prRangeFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s export [-format json|csv|mbox] [-mail-domain D] -from N [-to M]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	checkRange(fs, from, to)
+
+	var write func(w io.Writer, prs []*PR) error
+	switch *format {
+	case "json":
+		write = exportJSON
+	case "csv":
+		write = exportCSV
+	case "mbox":
+		if *domain == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+		write = func(w io.Writer, prs []*PR) error {
+			return exportMbox(w, prs, *domain)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var prs []*PR
+	for _, r := range scanPRs(*from, *to) {
+		if r.status == scanError {
+			fmt.Fprintf(os.Stderr, "PR %d: %v\n", r.number, r.err)
+		}
+		if r.pr != nil {
+			prs = append(prs, r.pr)
+		}
+	}
+	if err := write(os.Stdout, prs); err != nil {
+		exitf("Cannot export: %v", err)
+	}
+}
+
+func exportJSON(w io.Writer, prs []*PR) error {
+	list := make([]exportedPR, 0, len(prs))
+	for _, pr := range prs {
+		list = append(list, exported(pr))
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(list)
+}
+
+func exportCSV(w io.Writer, prs []*PR) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"number", "category", "state", "severity", "responsible", "last_modified", "synopsis", "url"})
+	for _, pr := range prs {
+		lastModified := ""
+		if !pr.LastModified.IsZero() {
+			lastModified = pr.LastModified.Format(time.RFC3339)
+		}
+		cw.Write([]string{
+			strconv.Itoa(pr.Number), pr.Category, pr.State, pr.Severity,
+			pr.Responsible, lastModified, pr.Synopsis, toGnatsUrl(pr.Number),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportMbox writes each PR as a mail, in mboxrd format, with Message-IDs
+// in domain.
+func exportMbox(w io.Writer, prs []*PR, domain string) error {
+	for _, pr := range prs {
+		date := pr.LastModified
+		if date.IsZero() {
+			date = time.Now()
+		}
+		fmt.Fprintf(w, "From gnats@netbsd.org %s\n", date.UTC().Format(time.ANSIC))
+		fmt.Fprintf(w, "From: gnats@netbsd.org\n")
+		fmt.Fprintf(w, "Date: %s\n", date.Format(time.RFC1123Z))
+		fmt.Fprintf(w, "Subject: %s\n", mime.QEncoding.Encode("utf-8", fmt.Sprintf("PR/%d %s: %s", pr.Number, pr.Category, pr.Synopsis)))
+		fmt.Fprintf(w, "Message-ID: %s\n", prMessageID(domain, pr.Number))
+		fmt.Fprintf(w, "Content-Type: text/plain; charset=utf-8\n")
+		fmt.Fprintf(w, "X-GNATS-State: %s\n", mime.QEncoding.Encode("utf-8", pr.State))
+		fmt.Fprintf(w, "X-GNATS-Severity: %s\n", mime.QEncoding.Encode("utf-8", pr.Severity))
+		fmt.Fprintf(w, "X-GNATS-Responsible: %s\n", mime.QEncoding.Encode("utf-8", pr.Responsible))
+		fmt.Fprintf(w, "\n%s\n\n", toGnatsUrl(pr.Number))
+
+		for _, line := range strings.Split(pr.Description, "\n") {
+			if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				line = ">" + line
+			}
+			fmt.Fprintf(w, "%s\n", line)
+		}
+		if _, err := fmt.Fprintf(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
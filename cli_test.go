@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExportMbox(t *testing.T) {
+	var buf bytes.Buffer
+	prs := []*PR{{Number: 55555, Category: "kern", State: "open", Synopsis: "panic", Description: "From the console:\n>From here"}}
+	if err := exportMbox(&buf, prs, "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	// The same as the bot's mail about the PR, to thread with it.
+	if !strings.Contains(out, "\nMessage-ID: "+prMessageID("example.org", 55555)+"\n") {
+		t.Errorf("no Message-ID in example.org:\n%s", out)
+	}
+	if !strings.Contains(out, "\n>From the console:\n>>From here\n") {
+		t.Errorf("From lines not quoted:\n%s", out)
+	}
+}
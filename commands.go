@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+// commandFunc handles a "!name args..." message, in channel or by DM.
+type commandFunc func(c *irc.Client, m *irc.Message, args []string)
+
+var commands map[string]commandFunc
+
+func init() {
+	commands = map[string]commandFunc{
+		"digest":        cmdDigest,
+		"status":        cmdStatus,
+		"iam":           cmdIam,
+		"mentions":      cmdMentions,
+		"subscribe":     cmdSubscribe,
+		"unsubscribe":   cmdUnsubscribe,
+		"subscriptions": cmdSubscriptions,
+
+		"join":   admin("join", cmdJoin),
+		"part":   admin("part", cmdPart),
+		"say":    admin("say", cmdSay),
+		"mute":   admin("mute", cmdMute),
+		"reload": admin("reload", cmdReload),
+		"rescan": admin("rescan", cmdRescan),
+		"quit":   admin("quit", cmdQuit),
+	}
+}
+
+// handleCommand runs the command in m, if any, and reports whether it did.
+func handleCommand(c *irc.Client, m *irc.Message) bool {
+	msg := m.Trailing()
+	if !strings.HasPrefix(msg, "!") {
+		return false
+	}
+	fields := strings.Fields(msg[1:])
+	if len(fields) == 0 {
+		return false
+	}
+	cmd, ok := commands[strings.ToLower(fields[0])]
+	if !ok {
+		return false
+	}
+	cmd(c, m, fields[1:])
+	return true
+}
+
+// reply answers m where it was asked: in channel or by DM.
+func reply(c *irc.Client, m *irc.Message, text string) {
+	target := m.Prefix.Name
+	if c.FromChannel(m) {
+		target = m.Params[0]
+	}
+	say(c, priorityReply, target, text)
+}
+
+// privateLines sends lines to nick by DM.
+func privateLines(c *irc.Client, nick string, lines []string) {
+	for _, line := range lines {
+		say(c, priorityReply, nick, line)
+	}
+}
+
+// !digest full [#channel]
+func cmdDigest(c *irc.Client, m *irc.Message, args []string) {
+	if len(args) == 0 || args[0] != "full" {
+		reply(c, m, "Usage: !digest full [#channel]")
+		return
+	}
+
+	var ch *ChannelConfig
+	switch {
+	case len(args) > 1:
+		ch = findChannel(args[1])
+	case c.FromChannel(m):
+		ch = findChannel(m.Params[0])
+	default:
+		ch = channels()[0]
+	}
+	if ch == nil {
+		reply(c, m, "I don't post to that channel")
+		return
+	}
+
+	privateLines(c, m.Prefix.Name, digestFull(ch))
+}
+
+// !status
+func cmdStatus(c *irc.Client, m *irc.Message, args []string) {
+	st := botStatus()
+	lag := "unknown"
+	if st.LagKnown {
+		lag = st.Lag.Round(time.Millisecond).String()
+	}
+
+	conn := "Not connected"
+	if st.Server != "" {
+		conn = fmt.Sprintf("Connected to %s for %v", st.Server, time.Since(st.Since).Round(time.Second))
+	}
+
+	reply(c, m, fmt.Sprintf("%s, lag %s, up %v, in %d channels, tracking %d PRs, latest PR %d, %d messages queued",
+		conn, lag, st.Uptime.Round(time.Second), st.Channels, st.TrackedPRs, st.LatestPR, st.Queued))
+}
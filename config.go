@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+// Config is the optional JSON configuration file passed with -config.
+// Anything not set in it falls back to the command line flags.
+type Config struct {
+	// Servers of the network, as host:port, tried in turn.
+	Servers []string `json:"servers"`
+
+	Channels []*ChannelConfig `json:"channels"`
+
+	// Nicks maps GNATS Responsible logins to IRC nicks.
+	Nicks map[string]string `json:"nicks"`
+	// Accounts maps GNATS Responsible logins to the NickServ account or
+	// Matrix user ID allowed to claim them with !iam. Logins not listed
+	// may be claimed by the account of the same name.
+	Accounts map[string]string `json:"accounts"`
+
+	Stale *StaleConfig `json:"stale"`
+
+	// Rules are watch rules evaluated against new PRs.
+	Rules []*Rule `json:"rules"`
+
+	// Style is the built in set of formats to use, "plain" or "color".
+	Style string `json:"style"`
+	// Formats overrides the style's text/template for "lookup", "new",
+	// "state" or "digest" lines.
+	Formats map[string]string `json:"formats"`
+
+	Flood *FloodConfig `json:"flood"`
+
+	// InviteFrom lists the nick!user@host masks, with * and ? wildcards,
+	// whose INVITEs the bot follows.
+	InviteFrom []string `json:"invite_from"`
+
+	// AdminAccounts and AdminMasks are who may use admin commands: those
+	// logged in to one of the NickServ accounts, or matching one of the
+	// nick!user@host masks.
+	AdminAccounts []string `json:"admin_accounts"`
+	AdminMasks    []string `json:"admin_masks"`
+	// AuditLog is a file admin commands are recorded in, besides the log.
+	AuditLog string `json:"audit_log"`
+
+	Webhooks []*WebhookConfig `json:"webhooks"`
+
+	// PublicURL is where -http-listen is reached from outside, like
+	// https://bot.example.org/, for the links and IDs of the Atom feeds.
+	// Without it they are made from the Host of each request.
+	PublicURL string `json:"public_url"`
+
+	// Matrix connects the bot to a Matrix homeserver as well. Channels
+	// named by a Matrix room ID or alias are rooms there. Changes need a
+	// restart.
+	Matrix *MatrixConfig `json:"matrix"`
+
+	// Email mails PR events to subscribers. Enabling it needs a restart.
+	Email *EmailConfig `json:"email"`
+
+	formats     compiledFormats
+	inviteAllow []*regexp.Regexp
+	adminMasks  []*regexp.Regexp
+	publicURL   *url.URL
+}
+
+// FloodConfig sets how fast the bot may send. Both limits are token
+// buckets: Burst messages at once, then one per Interval.
+type FloodConfig struct {
+	// Interval and Burst apply to everything sent to the network.
+	Interval string `json:"interval"`
+	Burst    int    `json:"burst"`
+	// TargetInterval and TargetBurst apply per channel or nick.
+	TargetInterval string `json:"target_interval"`
+	TargetBurst    int    `json:"target_burst"`
+
+	interval, targetInterval time.Duration
+}
+
+// ChannelConfig describes one channel the bot joins and what it posts there.
+type ChannelConfig struct {
+	Name string `json:"name"`
+	// Key is the channel key, for channels with mode +k.
+	Key string `json:"key"`
+
+	// Categories limits announcements to these GNATS categories.
+	// Empty means all categories.
+	Categories []string `json:"categories"`
+
+	// StateChanges enables announcing state changes of tracked PRs.
+	StateChanges bool `json:"state_changes"`
+
+	// StaleReminders enables posting reminders about stale PRs.
+	StaleReminders bool `json:"stale_reminders"`
+
+	Digest *DigestConfig `json:"digest"`
+
+	// Style and Formats override the global ones for this channel.
+	Style   string            `json:"style"`
+	Formats map[string]string `json:"formats"`
+
+	formats compiledFormats
+}
+
+// DigestConfig schedules a periodic summary of PR activity.
+type DigestConfig struct {
+	// Period is "daily" or "weekly".
+	Period string `json:"period"`
+	// Time is the local time of day to post at, as "15:04".
+	Time string `json:"time"`
+	// Weekday is the day weekly digests are posted on.
+	Weekday string `json:"weekday"`
+	// Timezone is an IANA zone name, the system zone if empty.
+	Timezone string `json:"timezone"`
+
+	hour, minute int
+	weekday      time.Weekday
+	location     *time.Location
+}
+
+// StaleConfig enables reminders about PRs nobody has touched in a while.
+type StaleConfig struct {
+	// States that count as waiting on someone, "feedback" and
+	// "analyzed" if empty.
+	States []string `json:"states"`
+	// Days since Last-Modified after which a PR is stale.
+	Days int `json:"days"`
+	// Interval between runs, as a Go duration. Defaults to an hour.
+	Interval string `json:"interval"`
+	// Batch is the most reminders sent per run.
+	Batch int `json:"batch"`
+	// Scan is how many PRs are fetched per run looking for stale ones,
+	// starting at ScanFrom and wrapping around at the newest PR.
+	// ScanFrom defaults to the oldest PR tracked.
+	Scan     int `json:"scan"`
+	ScanFrom int `json:"scan_from"`
+	// RemindEvery is how many days to wait before reminding about the
+	// same PR again.
+	RemindEvery int `json:"remind_every"`
+	// DMResponsible sends reminders to the Responsible's nick instead
+	// of the channel, for logins listed in Nicks.
+	DMResponsible bool `json:"dm_responsible"`
+
+	interval time.Duration
+}
+
+var (
+	configMu sync.RWMutex
+	config   = &Config{}
+)
+
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", path, err)
+		}
+	}
+
+	if len(cfg.Channels) == 0 {
+		cfg.Channels = []*ChannelConfig{{
+			Name:       *ircChannel,
+			Categories: allowedCategories,
+		}}
+	}
+
+	if err := cfg.parseFormats(); err != nil {
+		return nil, err
+	}
+
+	for _, ch := range cfg.Channels {
+		if ch.Name == "" {
+			return nil, fmt.Errorf("channel without a name in %s", path)
+		}
+		if err := ch.parseFormats(); err != nil {
+			return nil, fmt.Errorf("formats for %s: %v", ch.Name, err)
+		}
+		if ch.Digest != nil {
+			if err := ch.Digest.parse(); err != nil {
+				return nil, fmt.Errorf("digest for %s: %v", ch.Name, err)
+			}
+		}
+	}
+
+	for _, r := range cfg.Rules {
+		if err := r.parse(); err != nil {
+			return nil, fmt.Errorf("rule %q: %v", r.Name, err)
+		}
+	}
+
+	if cfg.Flood != nil {
+		if err := cfg.Flood.parse(); err != nil {
+			return nil, fmt.Errorf("flood: %v", err)
+		}
+	}
+
+	if cfg.Stale != nil {
+		if err := cfg.Stale.parse(); err != nil {
+			return nil, fmt.Errorf("stale: %v", err)
+		}
+	}
+
+	for _, mask := range cfg.InviteFrom {
+		re, err := irc.MaskToRegex(mask)
+		if err != nil {
+			return nil, fmt.Errorf("invite mask %q: %v", mask, err)
+		}
+		cfg.inviteAllow = append(cfg.inviteAllow, re)
+	}
+	for _, w := range cfg.Webhooks {
+		if w.URL == "" {
+			return nil, fmt.Errorf("webhook without a url in %s", path)
+		}
+		for _, kind := range w.Events {
+			if kind != eventNew && kind != eventState {
+				return nil, fmt.Errorf("webhook %s: unknown event %q", w.URL, kind)
+			}
+		}
+	}
+
+	if cfg.PublicURL != "" {
+		u, err := url.Parse(cfg.PublicURL)
+		if err != nil || u.Scheme == "" || u.Hostname() == "" {
+			return nil, fmt.Errorf("public_url %q isn't an absolute URL", cfg.PublicURL)
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		cfg.publicURL = u
+	}
+
+	if cfg.Email != nil {
+		if err := cfg.Email.parse(); err != nil {
+			return nil, fmt.Errorf("email: %v", err)
+		}
+	}
+
+	if cfg.Matrix != nil {
+		if err := cfg.Matrix.parse(); err != nil {
+			return nil, fmt.Errorf("matrix: %v", err)
+		}
+	}
+
+	for _, mask := range cfg.AdminMasks {
+		re, err := irc.MaskToRegex(mask)
+		if err != nil {
+			return nil, fmt.Errorf("admin mask %q: %v", mask, err)
+		}
+		cfg.adminMasks = append(cfg.adminMasks, re)
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) parseFormats() error {
+	if _, ok := styles[cfg.Style]; cfg.Style != "" && !ok {
+		return fmt.Errorf("unknown style %q", cfg.Style)
+	}
+	var err error
+	cfg.formats, err = compileFormats(cfg.Formats)
+	return err
+}
+
+func (ch *ChannelConfig) parseFormats() error {
+	if _, ok := styles[ch.Style]; ch.Style != "" && !ok {
+		return fmt.Errorf("unknown style %q", ch.Style)
+	}
+	var err error
+	ch.formats, err = compileFormats(ch.Formats)
+	return err
+}
+
+func setConfig(cfg *Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	config = cfg
+}
+
+func getConfig() *Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+// joinChannels lists every channel the bot should be in: the ones it
+// posts to and the alert channels of rules.
+func (cfg *Config) joinChannels() []string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[strings.ToLower(name)] {
+			seen[strings.ToLower(name)] = true
+			names = append(names, name)
+		}
+	}
+	for _, ch := range cfg.Channels {
+		add(ch.Name)
+	}
+	for _, r := range cfg.Rules {
+		add(r.AlertChannel)
+	}
+	return names
+}
+
+func channels() []*ChannelConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config.Channels
+}
+
+func findChannel(name string) *ChannelConfig {
+	for _, ch := range channels() {
+		if strings.EqualFold(ch.Name, name) {
+			return ch
+		}
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+func (d *DigestConfig) parse() error {
+	switch d.Period {
+	case "":
+		d.Period = "daily"
+	case "daily", "weekly":
+	default:
+		return fmt.Errorf("unknown period %q", d.Period)
+	}
+
+	t, err := time.Parse("15:04", d.Time)
+	if err != nil {
+		return fmt.Errorf("bad time %q, expected HH:MM", d.Time)
+	}
+	d.hour, d.minute = t.Hour(), t.Minute()
+
+	if d.Period == "weekly" {
+		wd, ok := weekdays[strings.ToLower(d.Weekday)]
+		if !ok {
+			return fmt.Errorf("bad weekday %q", d.Weekday)
+		}
+		d.weekday = wd
+	}
+
+	d.location = time.Local
+	if d.Timezone != "" {
+		d.location, err = time.LoadLocation(d.Timezone)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// length is the span of time one digest covers.
+func (d *DigestConfig) length() time.Duration {
+	if d.Period == "weekly" {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// lastDue returns the most recent scheduled digest time not after now.
+func (d *DigestConfig) lastDue(now time.Time) time.Time {
+	t := now.In(d.location)
+	due := time.Date(t.Year(), t.Month(), t.Day(), d.hour, d.minute, 0, 0, d.location)
+	if due.After(t) {
+		due = due.AddDate(0, 0, -1)
+	}
+	if d.Period == "weekly" {
+		for due.Weekday() != d.weekday {
+			due = due.AddDate(0, 0, -1)
+		}
+	}
+	return due
+}
+
+func (s *StaleConfig) parse() error {
+	if len(s.States) == 0 {
+		s.States = []string{"feedback", "analyzed"}
+	}
+	if s.Days <= 0 {
+		return fmt.Errorf("days must be positive")
+	}
+	if s.Batch <= 0 {
+		s.Batch = 3
+	}
+	if s.Scan <= 0 {
+		s.Scan = 50
+	}
+	if s.RemindEvery <= 0 {
+		s.RemindEvery = 30
+	}
+
+	s.interval = time.Hour
+	if s.Interval != "" {
+		d, err := time.ParseDuration(s.Interval)
+		if err != nil {
+			return err
+		}
+		s.interval = d
+	}
+
+	return nil
+}
+
+func (f *FloodConfig) parse() error {
+	f.interval, f.targetInterval = defaultSendInterval, defaultTargetInterval
+	for _, d := range []struct {
+		text string
+		dur  *time.Duration
+	}{
+		{f.Interval, &f.interval},
+		{f.TargetInterval, &f.targetInterval},
+	} {
+		if d.text == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.text)
+		if err != nil {
+			return err
+		}
+		if v <= 0 {
+			return fmt.Errorf("interval must be positive")
+		}
+		*d.dur = v
+	}
+	if f.Burst <= 0 {
+		f.Burst = defaultSendBurst
+	}
+	if f.TargetBurst <= 0 {
+		f.TargetBurst = defaultTargetBurst
+	}
+	return nil
+}
+
+// floodLimits returns the configured send limits, or the defaults.
+func (cfg *Config) floodLimits() *FloodConfig {
+	if cfg.Flood != nil {
+		return cfg.Flood
+	}
+	f := &FloodConfig{}
+	f.parse()
+	return f
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDigestLastDue(t *testing.T) {
+	utc := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	// 2020-03-04 was a Wednesday. Berlin moved to summer time on
+	// 2020-03-29.
+	tests := []struct {
+		digest   DigestConfig
+		now, due string
+	}{
+		{DigestConfig{Time: "09:00", Timezone: "UTC"}, "2020-03-04 12:00", "2020-03-04 09:00"},
+		{DigestConfig{Time: "09:00", Timezone: "UTC"}, "2020-03-04 09:00", "2020-03-04 09:00"},
+		{DigestConfig{Time: "09:00", Timezone: "UTC"}, "2020-03-04 08:59", "2020-03-03 09:00"},
+		{DigestConfig{Time: "23:30", Timezone: "UTC"}, "2020-03-01 00:10", "2020-02-29 23:30"},
+		{DigestConfig{Period: "weekly", Weekday: "Monday", Time: "09:00", Timezone: "UTC"}, "2020-03-04 12:00", "2020-03-02 09:00"},
+		{DigestConfig{Period: "weekly", Weekday: "wednesday", Time: "13:00", Timezone: "UTC"}, "2020-03-04 12:00", "2020-02-26 13:00"},
+		{DigestConfig{Period: "weekly", Weekday: "wednesday", Time: "12:00", Timezone: "UTC"}, "2020-03-04 12:00", "2020-03-04 12:00"},
+		{DigestConfig{Time: "09:00", Timezone: "Europe/Berlin"}, "2020-03-04 08:30", "2020-03-04 08:00"},
+		{DigestConfig{Time: "09:00", Timezone: "Europe/Berlin"}, "2020-03-29 08:30", "2020-03-29 07:00"},
+		{DigestConfig{Period: "weekly", Weekday: "sunday", Time: "09:00", Timezone: "Europe/Berlin"}, "2020-03-30 06:00", "2020-03-29 07:00"},
+	}
+	for _, test := range tests {
+		d := test.digest
+		if err := d.parse(); err != nil {
+			t.Fatalf("%+v: %v", test.digest, err)
+		}
+		if due := d.lastDue(utc(test.now)); !due.Equal(utc(test.due)) {
+			t.Errorf("%s %s %s %s: lastDue(%s) = %s, want %s", d.Period, d.Weekday, d.Time, d.Timezone,
+				test.now, due.UTC().Format("2006-01-02 15:04"), test.due)
+		}
+	}
+}
+
+func TestDigestParse(t *testing.T) {
+	for _, d := range []DigestConfig{
+		{Period: "monthly", Time: "09:00"},
+		{Time: "9am"},
+		{Time: "25:00"},
+		{Period: "weekly", Time: "09:00"},
+		{Period: "weekly", Weekday: "someday", Time: "09:00"},
+		{Time: "09:00", Timezone: "Nowhere/Special"},
+	} {
+		if err := d.parse(); err == nil {
+			t.Errorf("%+v accepted", d)
+		}
+	}
+}
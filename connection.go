@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+const (
+	minReconnectDelay = 15 * time.Second
+	maxReconnectDelay = 10 * time.Minute
+	// The backoff only starts over after a connection lasted this long,
+	// so a server that accepts and immediately drops us is still backed
+	// off from.
+	stableConnection = 5 * time.Minute
+)
+
+// The connection being run, for status reports and to drop it early.
+var (
+	connMu     sync.Mutex
+	connServer string
+	connSince  time.Time
+	connCancel context.CancelFunc
+)
+
+// disconnect drops the current connection, which is then re-established
+// like after any other disconnection.
+func disconnect(reason string) {
+	connMu.Lock()
+	defer connMu.Unlock()
+	if connCancel != nil {
+		ircLog.Info("Disconnecting", "reason", reason)
+		connCancel()
+	}
+}
+
+// connectionInfo returns the server we are connected to and since when,
+// or "" if we aren't.
+func connectionInfo() (string, time.Time) {
+	connMu.Lock()
+	defer connMu.Unlock()
+	return connServer, connSince
+}
+
+// ircServers returns the servers to rotate through: the config file's, or
+// the comma separated -irc-server list.
+func ircServers() []string {
+	if servers := getConfig().Servers; len(servers) > 0 {
+		return servers
+	}
+	var servers []string
+	for _, s := range strings.Split(*ircServer, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// jitter spreads d by up to a fifth either way, so a netsplit doesn't
+// have every bot reconnecting in lockstep.
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d) / 5
+	return d - time.Duration(spread) + time.Duration(rand.Int63n(2*spread+1))
+}
+
+// connectForever keeps the bot connected, until we are shutting down. A
+// failed connection moves on to the next server, and each failure doubles
+// the delay before trying again.
+func connectForever(clientConfig irc.ClientConfig, connectTimeout time.Duration) {
+	delay := minReconnectDelay
+	next := 0
+	for !isStopping() {
+		servers := ircServers()
+		if len(servers) == 0 {
+			ircLog.Fatal("No IRC server to connect to")
+		}
+		server := servers[next%len(servers)]
+
+		ircLog.Info("Connecting", "server", server)
+		conn, err := net.DialTimeout("tcp", server, connectTimeout)
+		if err != nil {
+			ircLog.Warn("Cannot connect", "server", server, "err", err)
+			next++
+		} else {
+			started := time.Now()
+			client := irc.NewClient(conn, clientConfig)
+			// Who is logged in as whom, for admin commands.
+			client.CapRequest("account-tag", false)
+			client.CapRequest("extended-join", false)
+			client.CapRequest("account-notify", false)
+			client.Writer.DebugCallback = watchOutgoing
+			if *debug {
+				client.Reader.DebugCallback = logIncoming
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			connMu.Lock()
+			connServer, connSince, connCancel = server, started, cancel
+			connMu.Unlock()
+
+			err = client.RunContext(ctx)
+			cancel()
+
+			connMu.Lock()
+			connServer, connCancel = "", nil
+			connMu.Unlock()
+			setCurrentClient(nil)
+			countReconnect()
+			clearSendQueue()
+			resetLag()
+			resetNames()
+			resetWhois()
+			resetChannels()
+			resetAccounts()
+			ircLog.Warn("Disconnected", "server", server, "err", err)
+
+			if time.Since(started) >= stableConnection {
+				delay = minReconnectDelay
+			} else {
+				next++
+			}
+		}
+
+		if isStopping() {
+			return
+		}
+		wait := jitter(delay)
+		ircLog.Info("Reconnecting", "in", wait.Round(time.Second))
+		if !sleep(wait) {
+			return
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
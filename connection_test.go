@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// testConnection runs a client on one end of a pipe, returning the
+// other end, the lines the client writes, and RunContext's result.
+func testConnection(ctx context.Context) (net.Conn, <-chan string, <-chan error) {
+	server, conn := net.Pipe()
+	c := irc.NewClient(conn, irc.ClientConfig{
+		Nick:    "gnatsirc",
+		User:    "gnatsirc",
+		Handler: irc.HandlerFunc(handleMessage),
+	})
+	lines := make(chan string, 100)
+	go func() {
+		s := bufio.NewScanner(server)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+		close(lines)
+	}()
+	done := make(chan error, 1)
+	go func() { done <- c.RunContext(ctx) }()
+	return server, lines, done
+}
+
+func TestReconnectWhileLookupHangs(t *testing.T) {
+	started := make(chan struct{}, 1)
+	defer func(old *http.Client) { gnatsHTTP = old }(gnatsHTTP)
+	gnatsHTTP = &http.Client{
+		Timeout: 100 * time.Millisecond,
+		// GNATS never answers.
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			started <- struct{}{}
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server, _, done := testConnection(ctx)
+	server.Write([]byte(":alice!alice@example.org PRIVMSG #netbsd :see PR 55501\r\n"))
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("PR not looked up")
+	}
+	// As a PING timeout or too much lag would.
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not torn down while the lookup hangs")
+	}
+	server.Close()
+
+	// The next connection is handled.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	server, lines, done := testConnection(ctx)
+	defer server.Close()
+	server.Write([]byte("PING :still-there\r\n"))
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			if m, err := irc.ParseMessage(line); err == nil && m.Command == "PONG" && m.Trailing() == "still-there" {
+				return
+			}
+		case err := <-done:
+			t.Fatalf("connection ended: %v", err)
+		case <-timeout:
+			t.Fatal("no PONG on the next connection")
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/irc.v3"
+)
+
+// logLineRegexp matches the lines of common IRC client logs, like
+// "[12:34] <nick> text" or "2020-01-02 12:34:56 <@nick> text".
+var logLineRegexp = regexp.MustCompile(`^(?:[\[(]?[-0-9:T. ]+[\])]?\s+)?<[~&@%+ ]?([^>\s]+)>\s?(.*)$`)
+
+// consoleConn stands in for the server connection in the console. What
+// the bot writes to it, like WHOIS, is shown in verbose mode.
+type consoleConn struct {
+	io.Reader
+	verbose bool
+}
+
+func (c *consoleConn) Write(p []byte) (int, error) {
+	if c.verbose {
+		fmt.Printf("-> %s", p)
+	}
+	return len(p), nil
+}
+
+func (c *consoleConn) Close() error { return nil }
+
+// consoleMessage turns a line of input into the PRIVMSG it stands for:
+// a raw IRC line, a line from an IRC client log, or just text said by
+// someone in channel.
+func consoleMessage(line, channel string) *irc.Message {
+	if strings.HasPrefix(line, ":") {
+		if m, err := irc.ParseMessage(line); err == nil && m.Command == "PRIVMSG" && len(m.Params) == 2 {
+			return m
+		}
+	}
+
+	nick, text := "console", line
+	if match := logLineRegexp.FindStringSubmatch(line); match != nil {
+		nick, text = match[1], match[2]
+	}
+	return &irc.Message{
+		Prefix:  &irc.Prefix{Name: nick, User: nick, Host: "console"},
+		Command: "PRIVMSG",
+		Params:  []string{channel, text},
+	}
+}
+
+// gnatsirc console [-config file] [-channel #channel] [log file]
+func runConsole(args []string) {
+	fs := flag.NewFlagSet("console", flag.ExitOnError)
+	ircChannel = fs.String("channel", "#netbsd", "Channel the lines are said in, unless they are raw IRC lines")
+	ircUsername = fs.String("nick", "gnatsirc", "Nick of the bot")
+	configFile = fs.String("config", "", "JSON file with per-channel configuration, for formats and rules")
+	verbose := fs.Bool("v", false, "Also show the protocol lines the bot would send, like WHOIS")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s console [flags] [file]
+
+Reads lines from file, or stdin, as if said in a channel, and prints what
+the bot would say. A line may be raw IRC ("PRIVMSG" lines only), from an
+IRC client log ("[12:34] <nick> text") or just text.
+
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	in := io.Reader(os.Stdin)
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			exitf("Cannot open %s: %v", fs.Arg(0), err)
+		}
+		defer f.Close()
+		in = f
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		exitf("Cannot load config: %v", err)
+	}
+	setConfig(cfg)
+
+	quitMessage = new(string)
+	divert = func(m *irc.Message) {
+		fmt.Printf("%s %s: %s\n", m.Command, m.Params[0], m.Trailing())
+	}
+	c := irc.NewClient(&consoleConn{Reader: strings.NewReader(""), verbose: *verbose}, irc.ClientConfig{
+		Nick: *ircUsername,
+		User: *ircUsername,
+		Name: realName,
+	})
+	setCurrentClient(c)
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		handleMessage(c, consoleMessage(line, *ircChannel))
+	}
+	if err := scanner.Err(); err != nil {
+		exitf("Cannot read input: %v", err)
+	}
+}
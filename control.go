@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+var errNotConnected = errors.New("not connected to IRC")
+
+// Control is the API served as JSON-RPC on the -control-socket, for
+// "gnatsirc ctl".
+type Control struct{}
+
+type Status struct {
+	Server     string        `json:"server"`
+	Since      time.Time     `json:"since"`
+	Lag        time.Duration `json:"lag"`
+	LagKnown   bool          `json:"lag_known"`
+	Uptime     time.Duration `json:"uptime"`
+	Channels   int           `json:"channels"`
+	TrackedPRs int           `json:"tracked_prs"`
+	LatestPR   int           `json:"latest_pr"`
+	Queued     int           `json:"queued"`
+}
+
+type ChannelInfo struct {
+	Name   string `json:"name"`
+	Joined bool   `json:"joined"`
+}
+
+type ChannelArgs struct {
+	Channel string `json:"channel"`
+	Reason  string `json:"reason"`
+}
+
+type SendArgs struct {
+	Target string `json:"target"`
+	Text   string `json:"text"`
+}
+
+// botStatus is what !status and the control socket report.
+func botStatus() Status {
+	server, since := connectionInfo()
+	lag, lagKnown := currentLag()
+
+	stateMu.Lock()
+	tracked := len(state.PRs)
+	stateMu.Unlock()
+
+	queued := 0
+	for _, n := range queueDepth() {
+		queued += n
+	}
+
+	return Status{
+		Server:     server,
+		Since:      since,
+		Lag:        lag,
+		LagKnown:   lagKnown,
+		Uptime:     time.Since(startTime),
+		Channels:   len(joinedChannels()),
+		TrackedPRs: tracked,
+		LatestPR:   latestPR(),
+		Queued:     queued,
+	}
+}
+
+func (Control) Status(_ struct{}, reply *Status) error {
+	*reply = botStatus()
+	return nil
+}
+
+func (Control) Channels(_ struct{}, reply *[]ChannelInfo) error {
+	joined := make(map[string]bool)
+	for _, name := range joinedChannels() {
+		joined[nickKey(name)] = true
+	}
+	seen := make(map[string]bool)
+	var list []ChannelInfo
+	for _, name := range append(desiredChannels(), joinedChannels()...) {
+		if !seen[nickKey(name)] {
+			seen[nickKey(name)] = true
+			list = append(list, ChannelInfo{Name: name, Joined: joined[nickKey(name)]})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	*reply = list
+	return nil
+}
+
+func (Control) Join(args ChannelArgs, reply *string) error {
+	c := currentClient()
+	if c == nil {
+		return errNotConnected
+	}
+	if !isChannelName(args.Channel) {
+		return fmt.Errorf("%q isn't a channel", args.Channel)
+	}
+	audit("control socket", "join", []string{args.Channel}, true)
+	joinChannel(c, args.Channel)
+	*reply = "Joining " + args.Channel
+	return nil
+}
+
+func (Control) Part(args ChannelArgs, reply *string) error {
+	c := currentClient()
+	if c == nil {
+		return errNotConnected
+	}
+	if args.Reason == "" {
+		args.Reason = "Leaving"
+	}
+	audit("control socket", "part", []string{args.Channel}, true)
+	leaveChannel(c, args.Channel, args.Reason)
+	*reply = "Leaving " + args.Channel
+	return nil
+}
+
+// Poll looks for new PRs now.
+func (Control) Poll(_ struct{}, reply *string) error {
+	select {
+	case pollNow <- struct{}{}:
+	default:
+	}
+	*reply = "Polling"
+	return nil
+}
+
+// SetWatermark makes the next poll look for new PRs from pr on.
+func (Control) SetWatermark(pr int, reply *string) error {
+	if pr <= 0 {
+		return fmt.Errorf("bad PR number %d", pr)
+	}
+	audit("control socket", "rescan", []string{strconv.Itoa(pr)}, true)
+	select {
+	case rescanFrom <- pr:
+	default:
+		return errors.New("a rescan is already pending")
+	}
+	*reply = fmt.Sprintf("Looking for new PRs from %d", pr)
+	return nil
+}
+
+func (Control) Reload(_ struct{}, reply *string) error {
+	audit("control socket", "reload", nil, true)
+	cfg, err := reloadConfig()
+	if err != nil {
+		return err
+	}
+	*reply = fmt.Sprintf("Reloaded, %d channels configured", len(cfg.Channels))
+	return nil
+}
+
+func (Control) Send(args SendArgs, reply *string) error {
+	c := currentClient()
+	if c == nil {
+		return errNotConnected
+	}
+	if args.Target == "" || args.Text == "" {
+		return errors.New("need a target and text")
+	}
+	audit("control socket", "say", []string{args.Target, args.Text}, true)
+	writeMessage(c, priorityReply, &irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{args.Target, args.Text},
+	})
+	*reply = "Sent"
+	return nil
+}
+
+// listenControl listens on the Unix socket at path, which only our user
+// may connect to. A socket left behind by a previous run is replaced, but
+// not one still in use.
+func listenControl(path string) (*net.UnixListener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use, is the bot already running?", path)
+		}
+	}
+
+	// The socket is made in a directory only we can enter, so nobody can
+	// connect before it is restricted, then moved into place.
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".gnatsirc-control")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serveControl serves the control API on the Unix socket at path.
+func serveControl(path string) {
+	l, err := listenControl(path)
+	if err != nil {
+		botLog.Fatal("Cannot listen on control socket", "path", path, "err", err)
+	}
+
+	server := rpc.NewServer()
+	server.Register(Control{})
+	go func() {
+		<-stopping
+		l.Close()
+		os.Remove(path)
+	}()
+
+	botLog.Info("Serving control socket", "path", path)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !isStopping() {
+				botLog.Error("Control socket failed", "err", err)
+			}
+			return
+		}
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+func ctlUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, `Usage: %s ctl -control-socket path <command>
+
+Commands:
+	status
+	channels
+	join <#channel>
+	part <#channel> [reason]
+	poll
+	watermark <PR number>
+	reload
+	send <target> <text>
+`, os.Args[0])
+	fs.PrintDefaults()
+	os.Exit(2)
+}
+
+// runCtl is "gnatsirc ctl ...", talking to a running bot.
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := fs.String("control-socket", "", "Control socket of the running bot")
+	fs.Usage = func() { ctlUsage(fs) }
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) == 0 || *socket == "" {
+		ctlUsage(fs)
+	}
+
+	client, err := jsonrpc.Dial("unix", *socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot connect to %s: %v\n", *socket, err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	var reply interface{}
+	var text string
+	switch cmd := args[0]; {
+	case cmd == "status" && len(args) == 1:
+		var status Status
+		err = client.Call("Control.Status", struct{}{}, &status)
+		reply = status
+	case cmd == "channels" && len(args) == 1:
+		var list []ChannelInfo
+		err = client.Call("Control.Channels", struct{}{}, &list)
+		reply = list
+	case cmd == "join" && len(args) == 2:
+		err = client.Call("Control.Join", ChannelArgs{Channel: args[1]}, &text)
+	case cmd == "part" && len(args) >= 2:
+		err = client.Call("Control.Part", ChannelArgs{Channel: args[1], Reason: strings.Join(args[2:], " ")}, &text)
+	case cmd == "poll" && len(args) == 1:
+		err = client.Call("Control.Poll", struct{}{}, &text)
+	case cmd == "watermark" && len(args) == 2:
+		pr, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			ctlUsage(fs)
+		}
+		err = client.Call("Control.SetWatermark", pr, &text)
+	case cmd == "reload" && len(args) == 1:
+		err = client.Call("Control.Reload", struct{}{}, &text)
+	case cmd == "send" && len(args) >= 3:
+		err = client.Call("Control.Send", SendArgs{Target: args[1], Text: strings.Join(args[2:], " ")}, &text)
+	default:
+		ctlUsage(fs)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if reply != nil {
+		out, _ := json.MarshalIndent(reply, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		fmt.Println(text)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenControl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gnatsirc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gnatsirc.sock")
+
+	l, err := listenControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v", fi.Mode())
+	}
+	go func(l *net.UnixListener) {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}(l)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+	conn.Close()
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("left behind %d files", len(entries)-1)
+	}
+
+	// A running bot's socket isn't taken over.
+	if l2, err := listenControl(path); err == nil {
+		l2.Close()
+		t.Error("listened on a socket in use")
+	}
+	l.Close()
+
+	// One left behind is.
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatal("socket removed on close")
+	}
+	l, err = listenControl(path)
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	l.Close()
+
+	// Anything else is left alone.
+	other := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(other, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listenControl(other); err == nil {
+		l.Close()
+		t.Error("replaced a file")
+	}
+	if data, _ := ioutil.ReadFile(other); string(data) != "{}" {
+		t.Error("file changed")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+const (
+	// Each nick gets at most one CTCP reply per ctcpUserInterval, and
+	// everyone together at most ctcpBurst per ctcpBurstInterval, so a
+	// channel-wide CTCP from a botnet can't flood us off.
+	ctcpUserInterval  = 5 * time.Second
+	ctcpBurst         = 5
+	ctcpBurstInterval = 10 * time.Second
+)
+
+// ctcpTypes are the CTCP queries answered, and what CLIENTINFO lists.
+var ctcpTypes = []string{"ACTION", "CLIENTINFO", "PING", "SOURCE", "TIME", "USERINFO", "VERSION"}
+
+var (
+	ctcpMu      sync.Mutex
+	ctcpLast    = make(map[string]time.Time)
+	ctcpReplies []time.Time
+)
+
+// ctcpAllowed applies the rate limits to a reply to nick.
+func ctcpAllowed(nick string, now time.Time) bool {
+	ctcpMu.Lock()
+	defer ctcpMu.Unlock()
+
+	if now.Sub(ctcpLast[nickKey(nick)]) < ctcpUserInterval {
+		return false
+	}
+
+	recent := ctcpReplies[:0]
+	for _, t := range ctcpReplies {
+		if now.Sub(t) < ctcpBurstInterval {
+			recent = append(recent, t)
+		}
+	}
+	ctcpReplies = recent
+	if len(ctcpReplies) >= ctcpBurst {
+		return false
+	}
+
+	ctcpReplies = append(ctcpReplies, now)
+	ctcpLast[nickKey(nick)] = now
+	for n, t := range ctcpLast {
+		if now.Sub(t) >= ctcpUserInterval {
+			delete(ctcpLast, n)
+		}
+	}
+	return true
+}
+
+// handleCTCP answers a CTCP query, in private or sent to a channel.
+func handleCTCP(c *irc.Client, m *irc.Message) {
+	ctcp, args := ctcpParse(m)
+
+	var reply string
+	switch ctcp {
+	case "PING":
+		reply = args
+	case "TIME":
+		reply = time.Now().Format(time.RFC1123Z)
+	case "CLIENTINFO":
+		reply = strings.Join(ctcpTypes, " ")
+	case "SOURCE":
+		reply = sourceURL
+	case "USERINFO":
+		reply = realName
+	case "VERSION":
+		reply = ctcpVersionReply
+	default:
+		return
+	}
+
+	if !ctcpAllowed(m.Prefix.Name, time.Now()) {
+		return
+	}
+	writeMessage(c, priorityReply, ctcpReply(m.Prefix.Name, ctcp, reply))
+}
+
+// messageText is the text of a PRIVMSG, including that of a CTCP ACTION.
+func messageText(m *irc.Message) string {
+	if isCTCP(m) && ctcpType(m) == "ACTION" {
+		_, text := ctcpParse(m)
+		return text
+	}
+	return m.Trailing()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+const (
+	// A digest more than this late (bot was down) is skipped.
+	digestGracePeriod = time.Hour
+	// Room for the PRIVMSG prefix and target within the 512 byte limit.
+	maxDigestLine = 400
+	// How many open critical PRs to list.
+	digestCriticalPRs = 3
+)
+
+// runDigests posts every configured channel digest when it comes due.
+func runDigests() {
+	for {
+		now := time.Now()
+		for _, ch := range channels() {
+			if ch.Digest == nil {
+				continue
+			}
+			due := ch.Digest.lastDue(now)
+
+			stateMu.Lock()
+			last := state.LastDigest[ch.Name]
+			stateMu.Unlock()
+			if !last.Before(due) {
+				continue
+			}
+
+			if now.Sub(due) <= digestGracePeriod {
+				c := clientFor(ch.Name)
+				if c == nil {
+					// Try again once we are connected.
+					continue
+				}
+				postDigest(c, ch, due)
+			} else {
+				announceLog.Warn("Skipping late digest", "channel", ch.Name, "due", due)
+			}
+
+			stateMu.Lock()
+			state.LastDigest[ch.Name] = due
+			saveStateLocked()
+			stateMu.Unlock()
+		}
+		watcherSucceeded("digests")
+		if !sleep(time.Minute) {
+			return
+		}
+	}
+}
+
+// channelEvents returns the events in the digest period ending at due
+// that belong in ch.
+func channelEvents(ch *ChannelConfig, due time.Time) []prEvent {
+	var evs []prEvent
+	for _, ev := range eventsSince(due.Add(-digestLength(ch)), due) {
+		if allowedCategory(ch, ev.Category) {
+			evs = append(evs, ev)
+		}
+	}
+	return evs
+}
+
+func digestLength(ch *ChannelConfig) time.Duration {
+	if ch.Digest == nil {
+		return 24 * time.Hour
+	}
+	return ch.Digest.length()
+}
+
+type digestCounts struct {
+	opened, closed, changed int
+}
+
+func (d *digestCounts) add(ev prEvent) {
+	switch {
+	case ev.Kind == eventNew:
+		d.opened++
+	case ev.NewState == "closed":
+		d.closed++
+	default:
+		d.changed++
+	}
+}
+
+func (d digestCounts) String() string {
+	var parts []string
+	if d.opened > 0 {
+		parts = append(parts, fmt.Sprintf("%d opened", d.opened))
+	}
+	if d.closed > 0 {
+		parts = append(parts, fmt.Sprintf("%d closed", d.closed))
+	}
+	if d.changed > 0 {
+		parts = append(parts, fmt.Sprintf("%d changed state", d.changed))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// digestSummary builds the short digest posted in channel.
+func digestSummary(ch *ChannelConfig, due time.Time, nick string) []string {
+	evs := channelEvents(ch, due)
+	period := digestPeriod(ch)
+	title := strings.ToUpper(period[:1]) + period[1:]
+
+	var total digestCounts
+	perCategory := make(map[string]*digestCounts)
+	for _, ev := range evs {
+		total.add(ev)
+		if perCategory[ev.Category] == nil {
+			perCategory[ev.Category] = &digestCounts{}
+		}
+		perCategory[ev.Category].add(ev)
+	}
+
+	summary := total.String()
+	if summary == "" {
+		summary = "no PR activity"
+	}
+	lines := []string{render(ch.Name, formatDigest, &digestData{
+		Channel: ch.Name,
+		Period:  period,
+		Title:   title,
+		Opened:  total.opened,
+		Closed:  total.closed,
+		Changed: total.changed,
+		Summary: summary,
+	})}
+	if len(evs) == 0 {
+		return lines
+	}
+
+	categories := make([]string, 0, len(perCategory))
+	for cat := range perCategory {
+		categories = append(categories, cat)
+	}
+	sort.Strings(categories)
+	var items []string
+	for _, cat := range categories {
+		items = append(items, fmt.Sprintf("%s: %s", cat, perCategory[cat]))
+	}
+	lines = append(lines, joinLines(items, " | ", maxDigestLine)...)
+
+	var critical []string
+	for _, pr := range openTrackedPRs() {
+		if pr.Severity != "critical" || !allowedCategory(ch, pr.Category) {
+			continue
+		}
+		critical = append(critical, fmt.Sprintf("PR %d (%s) %s",
+			pr.Number, pr.Category, truncate(pr.Synopsis, 60)))
+		if len(critical) == digestCriticalPRs {
+			break
+		}
+	}
+	if len(critical) > 0 {
+		const label = "Oldest open critical: "
+		criticalLines := joinLines(critical, "; ", maxDigestLine-len(label))
+		criticalLines[0] = label + criticalLines[0]
+		lines = append(lines, criticalLines...)
+	}
+
+	lines = append(lines, fmt.Sprintf("Full list: /msg %s !digest full %s", nick, ch.Name))
+	return lines
+}
+
+// digestFull lists every event of the last digest period, one per line.
+func digestFull(ch *ChannelConfig) []string {
+	due := time.Now()
+	if ch.Digest != nil {
+		due = ch.Digest.lastDue(due)
+	}
+	evs := channelEvents(ch, due)
+	if len(evs) == 0 {
+		return []string{fmt.Sprintf("No PR activity for %s", ch.Name)}
+	}
+
+	lines := make([]string, 0, len(evs))
+	for i := range evs {
+		lines = append(lines, formatEvent(ch.Name, &evs[i], nil))
+	}
+	return lines
+}
+
+func digestPeriod(ch *ChannelConfig) string {
+	if ch.Digest == nil {
+		return "daily"
+	}
+	return ch.Digest.Period
+}
+
+func postDigest(c *irc.Client, ch *ChannelConfig, due time.Time) {
+	announceLog.Info("Posting digest", "period", digestPeriod(ch), "channel", ch.Name)
+	for _, line := range digestSummary(ch, due, ownNick()) {
+		say(c, priorityAnnounce, ch.Name, line)
+	}
+}
+
+// joinLines joins items with sep into as few lines of at most max bytes
+// as possible. Items are never split.
+func joinLines(items []string, sep string, max int) []string {
+	var lines []string
+	cur := ""
+	for _, item := range items {
+		if cur != "" && len(cur)+len(sep)+len(item) > max {
+			lines = append(lines, cur)
+			cur = ""
+		}
+		if cur != "" {
+			cur += sep
+		}
+		cur += item
+	}
+	if cur != "" {
+		lines = append(lines, cur)
+	}
+	return lines
+}
+
+// truncate shortens s to at most n runes, marking the cut with "...".
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-3]) + "..."
+}
@@ -0,0 +1,46 @@
+package main
+
+import "sync"
+
+// eventSink consumes PR events: the IRC announcer, subscriptions,
+// webhooks and mail. pr is the PR as just fetched.
+type eventSink func(ev *prEvent, pr *PR)
+
+var (
+	sinksMu sync.Mutex
+	sinks   []eventSink
+)
+
+func init() {
+	addSink(func(ev *prEvent, pr *PR) {
+		switch ev.Kind {
+		case eventNew:
+			announceNewPR(ev, pr)
+		case eventState:
+			announceStateChange(ev, pr)
+		}
+	})
+	addSink(func(ev *prEvent, pr *PR) {
+		notifySubscribers(ev)
+	})
+	addSink(queueWebhooks)
+	addSink(queueMails)
+}
+
+func addSink(s eventSink) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	sinks = append(sinks, s)
+}
+
+// publish hands ev to every sink. Sinks must not block for long; those
+// that talk to the network queue the event and deliver it later.
+func publish(ev *prEvent, pr *PR) {
+	sinksMu.Lock()
+	all := append([]eventSink(nil), sinks...)
+	sinksMu.Unlock()
+
+	for _, s := range all {
+		s(ev, pr)
+	}
+}
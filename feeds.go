@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Entries in a feed, and results of /api/recent and /api/search.
+	maxFeedEntries   = 100
+	maxSearchResults = 100
+	// /api/recent covers this many days unless asked for others.
+	defaultRecentDays = 7
+	// /api/pr may fetch untracked PRs from GNATS this fast.
+	apiFetchInterval = 2 * time.Second
+	apiFetchBurst    = 5
+	// feedTagDate is the date in the feeds' tag: URIs, RFC 4151.
+	feedTagDate = "2020"
+)
+
+// apiFetches limits how often API clients make the bot fetch from GNATS.
+var apiFetches = struct {
+	sync.Mutex
+	bucket *tokenBucket
+}{bucket: newTokenBucket(apiFetchInterval, apiFetchBurst, time.Now())}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID       string       `xml:"id"`
+	Title    string       `xml:"title"`
+	Updated  string       `xml:"updated"`
+	Link     atomLink     `xml:"link"`
+	Category atomCategory `xml:"category"`
+	Summary  string       `xml:"summary"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// apiEvent is an event as served by /api/recent.
+type apiEvent struct {
+	prEvent
+	URL string `json:"url"`
+}
+
+func registerFeeds(mux *http.ServeMux) {
+	mux.HandleFunc("/feed.atom", handleFeed)
+	mux.HandleFunc("/feed/", handleFeed)
+	mux.HandleFunc("/api/pr/", handleAPIPR)
+	mux.HandleFunc("/api/recent", handleAPIRecent)
+	mux.HandleFunc("/api/search", handleAPISearch)
+}
+
+// recentEvents returns the recorded events of the last days, newest
+// first, limited to category unless it is empty.
+func recentEvents(days int, category string) []prEvent {
+	now := time.Now()
+	all := eventsSince(now.AddDate(0, 0, -days), now.Add(time.Second))
+
+	var evs []prEvent
+	for i := len(all) - 1; i >= 0; i-- {
+		if category == "" || all[i].Category == category {
+			evs = append(evs, all[i])
+		}
+	}
+	return evs
+}
+
+// eventTitle is the plain text headline of ev.
+func eventTitle(ev *prEvent) string {
+	if ev.Kind == eventState {
+		return fmt.Sprintf("PR %d %s -> %s: %s", ev.Number, ev.OldState, ev.NewState, ev.Synopsis)
+	}
+	return fmt.Sprintf("New PR %d: %s", ev.Number, ev.Synopsis)
+}
+
+func eventSummary(ev *prEvent) string {
+	var parts []string
+	for _, f := range []struct{ name, value string }{
+		{"Category", ev.Category},
+		{"Severity", ev.Severity},
+		{"Responsible", ev.Responsible},
+		{"State", ev.NewState},
+	} {
+		if f.value != "" {
+			parts = append(parts, f.name+": "+f.value)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// publicBase is the absolute URL the HTTP listener is reached at, for
+// links: the configured public URL, or else the one r was sent to.
+func publicBase(r *http.Request) *url.URL {
+	if u := getConfig().publicURL; u != nil {
+		return u
+	}
+	u := &url.URL{Scheme: "http", Host: r.Host, Path: "/"}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	return u
+}
+
+// handleFeed serves /feed.atom, with all categories, and
+// /feed/<category>.atom.
+func handleFeed(w http.ResponseWriter, r *http.Request) {
+	category := ""
+	if r.URL.Path != "/feed.atom" {
+		name := strings.TrimPrefix(r.URL.Path, "/feed/")
+		if !strings.HasSuffix(name, ".atom") || strings.Contains(name, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		category = strings.TrimSuffix(name, ".atom")
+	}
+
+	evs := recentEvents(int(eventRetention/(24*time.Hour)), category)
+	if len(evs) > maxFeedEntries {
+		evs = evs[:maxFeedEntries]
+	}
+
+	base := publicBase(r)
+	self := base.ResolveReference(&url.URL{Path: strings.TrimPrefix(r.URL.Path, "/")})
+	tag := "tag:" + base.Hostname() + "," + feedTagDate + ":"
+	feed := atomFeed{
+		ID:      tag + "feed/" + category,
+		Title:   "GNATS problem reports",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Link:    []atomLink{{Href: self.String(), Rel: "self"}},
+		Author:  atomAuthor{Name: "gnatsirc"},
+	}
+	if category != "" {
+		feed.Title += " in " + category
+	}
+	if len(evs) > 0 {
+		feed.Updated = evs[0].Time.UTC().Format(time.RFC3339)
+	}
+	for i := range evs {
+		ev := &evs[i]
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:       fmt.Sprintf("%spr/%d/%s/%d", tag, ev.Number, ev.Kind, ev.Time.UnixNano()),
+			Title:    eventTitle(ev),
+			Updated:  ev.Time.UTC().Format(time.RFC3339),
+			Link:     atomLink{Href: toGnatsUrl(ev.Number)},
+			Category: atomCategory{Term: ev.Category},
+			Summary:  eventSummary(ev),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(&feed)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func jsonError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// handleAPIPR serves /api/pr/<number>, from the tracked PRs or else
+// fetched from GNATS, rate limited. Fetched PRs aren't tracked, so API
+// clients can't make the bot announce or forget anything.
+func handleAPIPR(w http.ResponseWriter, r *http.Request) {
+	num, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/pr/"))
+	if err != nil || num <= 0 {
+		jsonError(w, http.StatusBadRequest, "bad PR number")
+		return
+	}
+
+	stateMu.Lock()
+	t, ok := state.PRs[num]
+	var pr PR
+	if ok {
+		pr = t.PR
+	}
+	stateMu.Unlock()
+	if ok {
+		writeJSON(w, http.StatusOK, exported(&pr))
+		return
+	}
+
+	apiFetches.Lock()
+	wait := apiFetches.bucket.wait(time.Now())
+	if wait == 0 {
+		apiFetches.bucket.take()
+	}
+	apiFetches.Unlock()
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+		jsonError(w, http.StatusTooManyRequests, "too many requests for untracked PRs")
+		return
+	}
+
+	fetched, err := fetchPR(num)
+	if err == errNoSuchPR {
+		jsonError(w, http.StatusNotFound, "no such PR")
+		return
+	} else if err != nil {
+		jsonError(w, http.StatusBadGateway, "cannot fetch PR")
+		return
+	}
+	writeJSON(w, http.StatusOK, exported(fetched))
+}
+
+// handleAPIRecent serves /api/recent?days=N&category=C.
+func handleAPIRecent(w http.ResponseWriter, r *http.Request) {
+	days := defaultRecentDays
+	if d := r.URL.Query().Get("days"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n <= 0 {
+			jsonError(w, http.StatusBadRequest, "bad days")
+			return
+		}
+		days = n
+	}
+
+	list := []apiEvent{}
+	for _, ev := range recentEvents(days, r.URL.Query().Get("category")) {
+		list = append(list, apiEvent{prEvent: ev, URL: toGnatsUrl(ev.Number)})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleAPISearch serves /api/search?q=, finding tracked PRs whose number,
+// synopsis, category, state or responsible contains every word of q.
+func handleAPISearch(w http.ResponseWriter, r *http.Request) {
+	words := strings.Fields(strings.ToLower(r.URL.Query().Get("q")))
+	if len(words) == 0 {
+		jsonError(w, http.StatusBadRequest, "missing q")
+		return
+	}
+
+	var prs []PR
+	stateMu.Lock()
+	for _, t := range state.PRs {
+		text := strings.ToLower(strings.Join([]string{
+			strconv.Itoa(t.Number), t.Synopsis, t.Category, t.State, t.Responsible,
+		}, " "))
+		match := true
+		for _, word := range words {
+			if !strings.Contains(text, word) {
+				match = false
+				break
+			}
+		}
+		if match {
+			prs = append(prs, t.PR)
+		}
+	}
+	stateMu.Unlock()
+
+	sort.Slice(prs, func(i, j int) bool { return prs[i].Number > prs[j].Number })
+	if len(prs) > maxSearchResults {
+		prs = prs[:maxSearchResults]
+	}
+	list := []exportedPR{}
+	for i := range prs {
+		list = append(list, exported(&prs[i]))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
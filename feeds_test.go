@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFeedLinks(t *testing.T) {
+	stateMu.Lock()
+	oldState := state
+	state = newBotState()
+	state.Events = []prEvent{{Time: time.Now(), Kind: eventNew, Number: 55501, Category: "kern", Synopsis: "panic in uvm"}}
+	stateMu.Unlock()
+	defer func() {
+		stateMu.Lock()
+		state = oldState
+		stateMu.Unlock()
+	}()
+	old := getConfig()
+	defer setConfig(old)
+
+	feed := func() atomFeed {
+		r := httptest.NewRequest("GET", "/feed/kern.atom", nil)
+		r.Host = "bot.example.org:9101"
+		w := httptest.NewRecorder()
+		handleFeed(w, r)
+		var feed atomFeed
+		if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+			t.Fatal(err)
+		}
+		if len(feed.Link) != 1 || len(feed.Entries) != 1 {
+			t.Fatalf("feed = %+v", feed)
+		}
+		return feed
+	}
+
+	setConfig(&Config{})
+	f := feed()
+	if f.Link[0].Href != "http://bot.example.org:9101/feed/kern.atom" {
+		t.Errorf("self link %q", f.Link[0].Href)
+	}
+	if f.ID != "tag:bot.example.org,2020:feed/kern" || !strings.HasPrefix(f.Entries[0].ID, "tag:bot.example.org,2020:pr/55501/new/") {
+		t.Errorf("IDs %q and %q", f.ID, f.Entries[0].ID)
+	}
+
+	dir, err := ioutil.TempDir("", "gnatsirc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gnatsirc.json")
+	if err := ioutil.WriteFile(path, []byte(`{"channels": [{"name": "#netbsd"}], "public_url": "https://gnats-bot.example.org/bot"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfig(cfg)
+	f = feed()
+	if f.Link[0].Href != "https://gnats-bot.example.org/bot/feed/kern.atom" {
+		t.Errorf("self link %q", f.Link[0].Href)
+	}
+	if f.ID != "tag:gnats-bot.example.org,2020:feed/kern" {
+		t.Errorf("ID %q", f.ID)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Event types with their own output format.
+const (
+	formatLookup = "lookup"
+	formatNew    = "new"
+	formatState  = "state"
+	formatDigest = "digest"
+)
+
+// Built in styles. "plain" is what the bot always printed, and the default.
+var styles = map[string]map[string]string{
+	"plain": {
+		formatLookup: `[{{.PR.State}}] {{.URL}} ({{.PR.Category}}) {{.PR.Synopsis}}`,
+		formatNew:    `[new] {{.URL}} ({{.PR.Category}}) {{.PR.Synopsis}}`,
+		formatState:  `[{{.OldState}} -> {{.NewState}}] {{.URL}} ({{.PR.Category}}) {{.PR.Synopsis}}`,
+		formatDigest: `{{.Title}} digest: {{.Summary}}`,
+	},
+	"color": {
+		formatLookup: `[{{color (stateColor .PR.State) .PR.State}}] {{.URL}} ({{bold .PR.Category}}) {{color (severityColor .PR.Severity) .PR.Synopsis}}`,
+		formatNew:    `[{{color "lightblue" "new"}}] {{.URL}} ({{bold .PR.Category}}) {{color (severityColor .PR.Severity) .PR.Synopsis}}`,
+		formatState:  `[{{color (stateColor .OldState) .OldState}} -> {{color (stateColor .NewState) .NewState}}] {{.URL}} ({{bold .PR.Category}}) {{.PR.Synopsis}}`,
+		formatDigest: `{{bold .Title}} digest: {{.Summary}}`,
+	},
+}
+
+// formatData is what an event template sees.
+type formatData struct {
+	PR       *PR
+	URL      string
+	Channel  string
+	OldState string
+	NewState string
+}
+
+// digestData is what a digest template sees.
+type digestData struct {
+	Channel string
+	Period  string
+	Title   string
+	Opened  int
+	Closed  int
+	Changed int
+	// Summary is the counts as text, or "no PR activity".
+	Summary string
+}
+
+// IRC colour numbers, from the mIRC palette everyone implements.
+var ircColors = map[string]int{
+	"white":      0,
+	"black":      1,
+	"blue":       2,
+	"green":      3,
+	"red":        4,
+	"brown":      5,
+	"purple":     6,
+	"orange":     7,
+	"yellow":     8,
+	"lightgreen": 9,
+	"cyan":       10,
+	"lightcyan":  11,
+	"lightblue":  12,
+	"pink":       13,
+	"grey":       14,
+	"lightgrey":  15,
+}
+
+var formatFuncs = template.FuncMap{
+	"bold":      func(s string) string { return "\x02" + s + "\x02" },
+	"italic":    func(s string) string { return "\x1d" + s + "\x1d" },
+	"underline": func(s string) string { return "\x1f" + s + "\x1f" },
+	"color":     ircColor,
+	"truncate":  func(n int, s string) string { return truncate(s, n) },
+	"upper":     strings.ToUpper,
+	"lower":     strings.ToLower,
+	"severityColor": func(severity string) string {
+		switch severity {
+		case "critical":
+			return "red"
+		case "serious":
+			return "orange"
+		}
+		return ""
+	},
+	"stateColor": func(state string) string {
+		switch state {
+		case "closed":
+			return "green"
+		case "open":
+			return "red"
+		case "feedback", "analyzed":
+			return "yellow"
+		case "needs-pullups", "pending-pullups":
+			return "cyan"
+		}
+		return ""
+	},
+}
+
+// ircColor wraps s in a colour code. Unknown names leave s as it is, so
+// templates can use "" to mean no colour.
+func ircColor(name, s string) string {
+	n, ok := ircColors[name]
+	if !ok {
+		return s
+	}
+	// Always two digits, so text starting with a digit isn't eaten.
+	return fmt.Sprintf("\x03%02d%s\x03", n, s)
+}
+
+// compiledFormats are the parsed templates of one style or configuration.
+type compiledFormats map[string]*template.Template
+
+func compileFormats(formats map[string]string) (compiledFormats, error) {
+	compiled := make(compiledFormats)
+	for kind, text := range formats {
+		if _, ok := styles["plain"][kind]; !ok {
+			return nil, fmt.Errorf("unknown event type %q", kind)
+		}
+		tmpl, err := template.New(kind).Funcs(formatFuncs).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		compiled[kind] = tmpl
+	}
+	return compiled, nil
+}
+
+var compiledStyles = make(map[string]compiledFormats)
+
+func init() {
+	for name, formats := range styles {
+		compiledStyles[name] = mustCompileFormats(formats)
+	}
+}
+
+func mustCompileFormats(formats map[string]string) compiledFormats {
+	compiled, err := compileFormats(formats)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+// formatTemplate finds the template for kind in channel: the channel's own
+// formats, then its style, then the global formats and style.
+func formatTemplate(channel, kind string) *template.Template {
+	cfg := getConfig()
+	if ch := findChannel(channel); ch != nil {
+		if tmpl, ok := ch.formats[kind]; ok {
+			return tmpl
+		}
+		if ch.Style != "" {
+			return compiledStyles[ch.Style][kind]
+		}
+	}
+	if tmpl, ok := cfg.formats[kind]; ok {
+		return tmpl
+	}
+	if cfg.Style != "" {
+		return compiledStyles[cfg.Style][kind]
+	}
+	return compiledStyles["plain"][kind]
+}
+
+// render executes the template for kind in channel, falling back to the
+// plain style if the configured template fails.
+func render(channel, kind string, data interface{}) string {
+	var buf bytes.Buffer
+	err := formatTemplate(channel, kind).Execute(&buf, data)
+	if err == nil {
+		return buf.String()
+	}
+
+	announceLog.Error("Format failed", "kind", kind, "channel", channel, "err", err)
+	buf.Reset()
+	compiledStyles["plain"][kind].Execute(&buf, data)
+	return buf.String()
+}
+
+// formatPR formats a lookup or new PR line for channel.
+func formatPR(channel, kind string, pr *PR) string {
+	return render(channel, kind, &formatData{
+		PR:       pr,
+		URL:      toGnatsUrl(pr.Number),
+		Channel:  channel,
+		NewState: pr.State,
+	})
+}
+
+// formatEvent formats ev for channel. pr is the PR as it is now, or nil
+// if all we have is the event.
+func formatEvent(channel string, ev *prEvent, pr *PR) string {
+	if pr == nil {
+		pr = ev.pr()
+	}
+	kind := formatNew
+	if ev.Kind == eventState {
+		kind = formatState
+	}
+	return render(channel, kind, &formatData{
+		PR:       pr,
+		URL:      toGnatsUrl(ev.Number),
+		Channel:  channel,
+		OldState: ev.OldState,
+		NewState: ev.NewState,
+	})
+}
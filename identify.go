@@ -0,0 +1,200 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+const (
+	// How long to wait for NickServ before joining channels anyway.
+	identifyTimeout = 30 * time.Second
+	// How often to try getting our configured nick back.
+	nickRecoveryInterval = 2 * time.Minute
+	// RPL_LOGGEDIN, sent by servers with services integration.
+	rplLoggedIn = "900"
+)
+
+// What NickServ says, in the words of the common services packages.
+var (
+	nickServSuccess = []string{
+		"you are now identified",
+		"you are now logged in",
+		"password accepted",
+	}
+	nickServFailure = []string{
+		"invalid password",
+		"password incorrect",
+		"incorrect password",
+		"is not a registered nickname",
+		"isn't registered",
+		"not registered",
+	}
+	nickServUnknownCommand = []string{
+		"unknown command",
+		"invalid command",
+		"not a valid command",
+	}
+)
+
+// Identification state of the current connection. regainPending is set
+// while NickServ hasn't answered a REGAIN, and noRegain once it didn't know
+// the command, so GHOST is used instead.
+var (
+	identifyMu     sync.Mutex
+	identifyClient *irc.Client
+	identified     bool
+	channelsJoined bool
+	regainPending  bool
+	noRegain       bool
+)
+
+// onWelcome identifies with NickServ if we have a password, and joins our
+// channels once that is done, so they see us with our cloak and account.
+func onWelcome(c *irc.Client) {
+	identifyMu.Lock()
+	identifyClient = c
+	identified = false
+	channelsJoined = false
+	regainPending = false
+	noRegain = false
+	identifyMu.Unlock()
+
+	if ircPassword == "" {
+		joinChannels(c)
+		return
+	}
+
+	ircLog.Info("Identifying with NickServ")
+	say(c, priorityProtocol, "NickServ", "IDENTIFY "+*ircUsername+" "+ircPassword)
+	time.AfterFunc(identifyTimeout, func() {
+		identifyMu.Lock()
+		pending := identifyClient == c && !identified
+		identifyMu.Unlock()
+		if pending {
+			ircLog.Warn("NickServ didn't confirm identification, joining anyway")
+			joinChannels(c)
+		}
+	})
+}
+
+// joinChannels joins our channels, once per connection.
+func joinChannels(c *irc.Client) {
+	identifyMu.Lock()
+	if identifyClient != c || channelsJoined {
+		identifyMu.Unlock()
+		return
+	}
+	channelsJoined = true
+	identifyMu.Unlock()
+
+	joinAll(c)
+}
+
+func isIdentified() bool {
+	identifyMu.Lock()
+	defer identifyMu.Unlock()
+	return identified
+}
+
+// trackNickServ watches NickServ notices and RPL_LOGGEDIN to learn
+// whether IDENTIFY worked.
+func trackNickServ(c *irc.Client, m *irc.Message) {
+	switch {
+	case m.Command == rplLoggedIn:
+		identifySucceeded(c)
+	case m.Command == "NOTICE" && strings.EqualFold(m.Prefix.Name, "NickServ") && !c.FromChannel(m):
+		text := strings.ToLower(m.Trailing())
+		for _, s := range nickServUnknownCommand {
+			if strings.Contains(text, s) {
+				regainUnknown(c)
+				return
+			}
+		}
+		for _, s := range nickServSuccess {
+			if strings.Contains(text, s) {
+				identifySucceeded(c)
+				return
+			}
+		}
+		for _, s := range nickServFailure {
+			if strings.Contains(text, s) {
+				ircLog.Error("NickServ identification failed", "reply", m.Trailing())
+				joinChannels(c)
+				return
+			}
+		}
+	}
+}
+
+func identifySucceeded(c *irc.Client) {
+	identifyMu.Lock()
+	already := identified
+	identified = true
+	identifyMu.Unlock()
+
+	if !already {
+		ircLog.Info("Identified with NickServ")
+		recoverNick(c)
+	}
+	joinChannels(c)
+}
+
+// regainUnknown handles NickServ not knowing a command. If it was our
+// REGAIN, we try again with GHOST.
+func regainUnknown(c *irc.Client) {
+	identifyMu.Lock()
+	pending := regainPending
+	regainPending = false
+	if pending {
+		noRegain = true
+	}
+	identifyMu.Unlock()
+
+	if pending {
+		ircLog.Info("NickServ doesn't know REGAIN, trying GHOST")
+		recoverNick(c)
+	}
+}
+
+// recoverNick tries to get our configured nick back, if we ended up with
+// another after a netsplit or a ghost of ourselves. Once identified we
+// can ask NickServ to take it from whoever has it, with REGAIN or, on
+// networks without it, GHOST.
+func recoverNick(c *irc.Client) {
+	nick := ownNick()
+	if nickKey(nick) == nickKey(*ircUsername) {
+		identifyMu.Lock()
+		regainPending = false
+		identifyMu.Unlock()
+		return
+	}
+
+	ircLog.Info("Trying to regain nick", "nick", *ircUsername, "current", nick)
+	if ircPassword != "" && isIdentified() {
+		identifyMu.Lock()
+		ghost := noRegain
+		regainPending = !ghost
+		identifyMu.Unlock()
+		command := "REGAIN "
+		if ghost {
+			command = "GHOST "
+		}
+		say(c, priorityProtocol, "NickServ", command+*ircUsername+" "+ircPassword)
+	}
+	writeMessage(c, priorityProtocol, &irc.Message{
+		Command: "NICK",
+		Params:  []string{*ircUsername},
+	})
+}
+
+// runNickRecovery periodically tries to regain our nick.
+func runNickRecovery() {
+	for sleep(nickRecoveryInterval) {
+		if c := currentClient(); c != nil {
+			recoverNick(c)
+		}
+	}
+}
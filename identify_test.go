@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/irc.v3"
+)
+
+func TestRecoverNickFallsBackToGhost(t *testing.T) {
+	username, password := "gnatsirc", "hunter2"
+	defer func(u *string, p string) { ircUsername, ircPassword = u, p }(ircUsername, ircPassword)
+	ircUsername, ircPassword = &username, password
+
+	c := offlineClient
+	identifyMu.Lock()
+	identifyClient, identified, channelsJoined = c, true, true
+	identifyMu.Unlock()
+	selfMu.Lock()
+	selfNick = "gnatsirc_"
+	selfMu.Unlock()
+	defer func() {
+		identifyMu.Lock()
+		identifyClient, identified, regainPending, noRegain = nil, false, false, false
+		identifyMu.Unlock()
+		selfMu.Lock()
+		selfNick = ""
+		selfMu.Unlock()
+	}()
+
+	sent := func() []string {
+		sendQueue.Lock()
+		defer sendQueue.Unlock()
+		var lines []string
+		for _, q := range sendQueue.queues[priorityProtocol] {
+			lines = append(lines, q.m.String())
+		}
+		sendQueue.queues[priorityProtocol] = nil
+		return lines
+	}
+	nickServ := func(text string) {
+		trackNickServ(c, &irc.Message{
+			Prefix:  &irc.Prefix{Name: "NickServ", User: "NickServ", Host: "services."},
+			Command: "NOTICE",
+			// To the client's own nick, which the offline one
+			// doesn't have.
+			Params: []string{c.CurrentNick(), text},
+		})
+	}
+
+	recoverNick(c)
+	if got, want := sent(), []string{"PRIVMSG NickServ :REGAIN gnatsirc hunter2", "NICK gnatsirc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	nickServ("Unknown command regain. \"/msg NickServ HELP\" for help.")
+	if got, want := sent(), []string{"PRIVMSG NickServ :GHOST gnatsirc hunter2", "NICK gnatsirc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	// GHOST from now on, and other unknown commands don't matter.
+	nickServ("Unknown command frobnicate.")
+	recoverNick(c)
+	if got, want := sent(), []string{"PRIVMSG NickServ :GHOST gnatsirc hunter2", "NICK gnatsirc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+
+	selfMu.Lock()
+	selfNick = "gnatsirc"
+	selfMu.Unlock()
+	recoverNick(c)
+	if got := sent(); len(got) != 0 {
+		t.Errorf("sent %q with our nick", got)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+// Round trip times of the client's keepalive PINGs. The client doesn't
+// tell us when it sends one, so outgoing lines are watched for them.
+var (
+	lagMu    sync.Mutex
+	pingSent = make(map[string]time.Time)
+	lastLag  time.Duration
+	lagKnown bool
+)
+
+// watchPings is the writer's debug callback, noting when PINGs go out.
+func watchPings(line string) {
+	if !strings.HasPrefix(line, "PING :") {
+		return
+	}
+	lagMu.Lock()
+	defer lagMu.Unlock()
+	pingSent[strings.TrimPrefix(line, "PING :")] = time.Now()
+}
+
+// trackLag measures the lag when the PONG to one of our PINGs arrives,
+// and reconnects if the server has become too slow to be useful.
+func trackLag(m *irc.Message) {
+	if m.Command != "PONG" {
+		return
+	}
+
+	lagMu.Lock()
+	sent, ok := pingSent[m.Trailing()]
+	if !ok {
+		lagMu.Unlock()
+		return
+	}
+	delete(pingSent, m.Trailing())
+	lag := time.Since(sent)
+	lastLag, lagKnown = lag, true
+	lagMu.Unlock()
+
+	if *maxLag > 0 && lag > *maxLag {
+		disconnect("lag of " + lag.String() + " is too high")
+	}
+}
+
+// currentLag is the last measured lag, or how long the current PING has
+// been waiting for an answer if that is longer.
+func currentLag() (time.Duration, bool) {
+	lagMu.Lock()
+	defer lagMu.Unlock()
+
+	lag, known := lastLag, lagKnown
+	for _, sent := range pingSent {
+		if waiting := time.Since(sent); waiting > lag {
+			lag, known = waiting, true
+		}
+	}
+	return lag, known
+}
+
+func resetLag() {
+	lagMu.Lock()
+	defer lagMu.Unlock()
+	pingSent = make(map[string]time.Time)
+	lastLag, lagKnown = 0, false
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"gopkg.in/irc.v3"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(l), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// logger logs for one subsystem, whose verbosity can be set on its own
+// with -log-levels.
+type logger struct {
+	subsystem string
+}
+
+var (
+	// ircLog is the connection, registration and channels.
+	ircLog = &logger{"irc"}
+	// rawLog is the raw IRC traffic, with -debug.
+	rawLog = &logger{"raw"}
+	// gnatsLog is fetching PRs and watching for new and changed ones.
+	gnatsLog = &logger{"gnats"}
+	// announceLog is what gets posted: announcements, digests and
+	// reminders.
+	announceLog = &logger{"announce"}
+	// auditLog is who ran which admin command.
+	auditLog = &logger{"audit"}
+	// matrixLog is the Matrix sink.
+	matrixLog = &logger{"matrix"}
+	// botLog is everything else: state, shutdown, HTTP.
+	botLog = &logger{"bot"}
+)
+
+// Logging setup, done once by setupLogging before anything is logged.
+var (
+	logMu        sync.Mutex
+	logOut       io.Writer = os.Stderr
+	logJSON      bool
+	logDefault   = levelInfo
+	logLevels    = make(map[string]logLevel)
+	logChatLines bool
+)
+
+// setupLogging applies the logging flags. levels is a comma separated
+// list of subsystem=level.
+func setupLogging(level, levels, format string, content, debug bool) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logDefault = l
+	if debug {
+		logDefault = levelDebug
+	}
+
+	for _, pair := range strings.Split(levels, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return fmt.Errorf("log level %q isn't subsystem=level", pair)
+		}
+		l, err := parseLogLevel(pair[i+1:])
+		if err != nil {
+			return err
+		}
+		logLevels[pair[:i]] = l
+	}
+	if _, ok := logLevels[rawLog.subsystem]; !ok && !debug {
+		// Raw traffic is only wanted when asked for.
+		logLevels[rawLog.subsystem] = levelInfo
+	}
+
+	switch format {
+	case "text":
+	case "json":
+		logJSON = true
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	logChatLines = content
+	return nil
+}
+
+func (l *logger) enabled(level logLevel) bool {
+	min, ok := logLevels[l.subsystem]
+	if !ok {
+		min = logDefault
+	}
+	return level >= min
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+// Fatal logs an error and exits.
+func (l *logger) Fatal(msg string, kv ...interface{}) {
+	l.log(levelError, msg, kv)
+	os.Exit(1)
+}
+
+// log writes msg with the key value pairs kv as one line, logfmt style or
+// as a JSON object.
+func (l *logger) log(level logLevel, msg string, kv []interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	fields := []interface{}{
+		"time", time.Now().Format(time.RFC3339Nano),
+		"level", levelNames[level],
+		"subsystem", l.subsystem,
+		"msg", msg,
+	}
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	var b bytes.Buffer
+	if logJSON {
+		b.WriteByte('{')
+	}
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		value := logValue(fields[i+1])
+		if logJSON {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			k, _ := json.Marshal(key)
+			v, _ := json.Marshal(value)
+			b.Write(k)
+			b.WriteByte(':')
+			b.Write(v)
+			continue
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		if s, ok := value.(string); ok && needsQuoting(s) {
+			b.WriteString(strconv.Quote(s))
+		} else {
+			fmt.Fprint(&b, value)
+		}
+	}
+	if logJSON {
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	logOut.Write(b.Bytes())
+}
+
+func needsQuoting(s string) bool {
+	return s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r)
+	}) >= 0
+}
+
+// chatText is something people said, only logged with -log-content.
+type chatText string
+
+// logValue turns v into something that prints well in both formats.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case chatText:
+		if !logChatLines {
+			return fmt.Sprintf("[%d bytes]", len(v))
+		}
+		return string(v)
+	case *irc.Message:
+		return redactMessage(v)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case string, bool, int, int64, float64:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Commands to services whose arguments are passwords.
+var credentialCommands = []string{"IDENTIFY", "REGAIN", "GHOST", "RELEASE", "RECOVER"}
+
+// redactMessage returns m as a line of IRC, without passwords and, unless
+// -log-content was given, without what people said.
+func redactMessage(m *irc.Message) string {
+	switch m.Command {
+	case "PASS", "AUTHENTICATE", "OPER":
+		return m.Command + " [redacted]"
+	case "PRIVMSG", "NOTICE":
+		if len(m.Params) < 2 {
+			break
+		}
+		text := m.Trailing()
+		fields := strings.Fields(text)
+		for _, cmd := range credentialCommands {
+			if len(fields) > 0 && strings.EqualFold(fields[0], cmd) {
+				text = fields[0] + " [redacted]"
+			}
+		}
+		if text == m.Trailing() && !logChatLines {
+			text = fmt.Sprintf("[%d bytes]", len(text))
+		}
+		redacted := m.Copy()
+		redacted.Params[len(redacted.Params)-1] = text
+		return redacted.String()
+	}
+	return m.String()
+}
+
+// redactLine is redactMessage for raw lines.
+func redactLine(line string) string {
+	m, err := irc.ParseMessage(line)
+	if err != nil {
+		return "[unparsable line]"
+	}
+	return redactMessage(m)
+}
+
+// logIncoming and logOutgoing are the reader's and writer's debug
+// callbacks with -debug.
+func logIncoming(line string) {
+	if rawLog.enabled(levelDebug) {
+		rawLog.Debug("<-", "line", redactLine(line))
+	}
+}
+
+func logOutgoing(line string) {
+	if rawLog.enabled(levelDebug) {
+		rawLog.Debug("->", "line", redactLine(line))
+	}
+}
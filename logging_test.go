@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/irc.v3"
+)
+
+func TestRedactMessage(t *testing.T) {
+	defer func(old bool) { logChatLines = old }(logChatLines)
+
+	tests := []struct {
+		line          string
+		content, want string
+	}{
+		{"PASS hunter2", "", "PASS [redacted]"},
+		{"AUTHENTICATE Ym90AGJvdABodW50ZXIy", "", "AUTHENTICATE [redacted]"},
+		{"OPER bot hunter2", "", "OPER [redacted]"},
+		{"PRIVMSG NickServ :IDENTIFY gnatsirc hunter2", "", "PRIVMSG NickServ :IDENTIFY [redacted]"},
+		{"PRIVMSG NickServ :regain gnatsirc hunter2", "", "PRIVMSG NickServ :regain [redacted]"},
+		{"PRIVMSG NickServ :GHOST gnatsirc hunter2", "with content", "PRIVMSG NickServ :GHOST [redacted]"},
+		{"PRIVMSG #netbsd :PR 12345 is fixed", "", "PRIVMSG #netbsd :[17 bytes]"},
+		{"PRIVMSG #netbsd :PR 12345 is fixed", "with content", "PRIVMSG #netbsd :PR 12345 is fixed"},
+		{":alice!a@host NOTICE gnatsirc :hi", "", ":alice!a@host NOTICE gnatsirc :[2 bytes]"},
+		{"JOIN #netbsd", "", "JOIN #netbsd"},
+		{"PRIVMSG #netbsd", "", "PRIVMSG #netbsd"},
+	}
+	for _, test := range tests {
+		logChatLines = test.content != ""
+		m, err := irc.ParseMessage(test.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := redactMessage(m); got != test.want {
+			t.Errorf("redactMessage(%q) = %q, want %q", test.line, got, test.want)
+		}
+		if got := redactLine(test.line); got != test.want {
+			t.Errorf("redactLine(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
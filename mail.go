@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	mailTimeout = 30 * time.Second
+	// Failed mails are retried after mailRetryDelay, doubling up to
+	// mailMaxDelay, and dropped after mailMaxAge.
+	mailRetryDelay = time.Minute
+	mailMaxDelay   = time.Hour
+	mailMaxAge     = 24 * time.Hour
+	// How often the queue and digests are checked.
+	mailCheckInterval = 15 * time.Second
+	maxMailQueue      = 1000
+)
+
+// EmailConfig sends PR events by mail.
+type EmailConfig struct {
+	// Server is the SMTP server as host:port, usually the submission
+	// port 587. STARTTLS is used when the server offers it.
+	Server string `json:"server"`
+	// Username and Password log in with AUTH PLAIN, which requires the
+	// server to offer STARTTLS. The SMTP_PASSWORD environment variable
+	// is used if Password is empty.
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// From is the sender, like "GNATS bot <gnats-bot@example.org>".
+	From string `json:"from"`
+
+	// UnsubscribeURL is where the HTTP listener's /unsubscribe can be
+	// reached from outside, like https://bot.example.org/unsubscribe.
+	// UnsubscribeSecret signs the links. Both are required, as nothing
+	// reads replies to From.
+	UnsubscribeURL    string `json:"unsubscribe_url"`
+	UnsubscribeSecret string `json:"unsubscribe_secret"`
+
+	Subscribers []*EmailSubscriber `json:"subscribers"`
+
+	from *mail.Address
+	// tls, if set, is the TLS config to use for STARTTLS.
+	tls *tls.Config
+}
+
+// EmailSubscriber is an address PR events are mailed to.
+type EmailSubscriber struct {
+	// Address is reduced to the bare address when the config is loaded.
+	Address string `json:"address"`
+	// Events limits mails to "new" or "state" events. Empty means all.
+	Events []string `json:"events"`
+	// Categories limits mails to these GNATS categories. Empty means
+	// all.
+	Categories []string `json:"categories"`
+	// Digest batches the events into one mail per period instead of a
+	// mail each.
+	Digest *DigestConfig `json:"digest"`
+}
+
+// queuedMail is a mail waiting to be sent, kept in the state file. It is
+// a single event, or a digest of several.
+type queuedMail struct {
+	To       string    `json:"to"`
+	Events   []prEvent `json:"events"`
+	Digest   string    `json:"digest,omitempty"`
+	Created  time.Time `json:"created"`
+	Attempts int       `json:"attempts"`
+	NextTry  time.Time `json:"next_try"`
+}
+
+func (ec *EmailConfig) parse() error {
+	if ec.Password == "" {
+		ec.Password = os.Getenv("SMTP_PASSWORD")
+	}
+	if _, _, err := net.SplitHostPort(ec.Server); err != nil {
+		return fmt.Errorf("bad server %q: %v", ec.Server, err)
+	}
+	from, err := mail.ParseAddress(ec.From)
+	if err != nil {
+		return fmt.Errorf("bad from %q: %v", ec.From, err)
+	}
+	ec.from = from
+	if ec.UnsubscribeURL == "" || ec.UnsubscribeSecret == "" {
+		return errors.New("unsubscribe_url and unsubscribe_secret are required")
+	}
+	for _, s := range ec.Subscribers {
+		addr, err := mail.ParseAddress(s.Address)
+		if err != nil {
+			return fmt.Errorf("bad subscriber address %q: %v", s.Address, err)
+		}
+		s.Address = addr.Address
+		for _, kind := range s.Events {
+			if kind != eventNew && kind != eventState {
+				return fmt.Errorf("subscriber %s: unknown event %q", s.Address, kind)
+			}
+		}
+		if s.Digest != nil {
+			if err := s.Digest.parse(); err != nil {
+				return fmt.Errorf("digest for %s: %v", s.Address, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *EmailSubscriber) wants(ev *prEvent) bool {
+	if len(s.Events) > 0 && !contains(s.Events, ev.Kind) {
+		return false
+	}
+	return len(s.Categories) == 0 || contains(s.Categories, ev.Category)
+}
+
+// unsubscribedLocked reports whether address used an unsubscribe link.
+// The caller must hold stateMu.
+func unsubscribedLocked(address string) bool {
+	_, ok := state.Unsubscribed[strings.ToLower(address)]
+	return ok
+}
+
+// prMessageID is the Message-ID of the mail about a new PR, which mails
+// about its state changes refer to, so they thread together, also with
+// the mails of "gnatsirc export -format mbox" given the same domain.
+func prMessageID(domain string, num int) string {
+	return fmt.Sprintf("<pr-%d@%s>", num, domain)
+}
+
+// queueMailLocked adds a mail to the queue and reports whether it did.
+// The caller must hold stateMu.
+func queueMailLocked(qm *queuedMail) bool {
+	// The queue is in the state file, which a dry run may share with
+	// the real bot.
+	if isDryRun() {
+		announceLog.Info("Dry run, not sending mail", "to", qm.To, "events", len(qm.Events))
+		return false
+	}
+	if len(state.Mail) >= maxMailQueue {
+		botLog.Warn("Mail queue full, dropping oldest mail", "to", state.Mail[0].To)
+		state.Mail = state.Mail[1:]
+	}
+	state.Mail = append(state.Mail, qm)
+	return true
+}
+
+// queueMails is the event sink mailing ev to every subscriber that wants
+// it right away.
+func queueMails(ev *prEvent, pr *PR) {
+	ec := getConfig().Email
+	if ec == nil {
+		return
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	queued := false
+	for _, s := range ec.Subscribers {
+		if s.Digest != nil || !s.wants(ev) || unsubscribedLocked(s.Address) {
+			continue
+		}
+		if queueMailLocked(&queuedMail{To: s.Address, Events: []prEvent{*ev}, Created: time.Now()}) {
+			queued = true
+		}
+	}
+	if queued {
+		saveStateLocked()
+	}
+}
+
+// queueMailDigests queues the digests that have come due. Like channel
+// digests, they are kept in LastDigest, as "mailto:<address>".
+func queueMailDigests(ec *EmailConfig, now time.Time) {
+	for _, s := range ec.Subscribers {
+		if s.Digest == nil {
+			continue
+		}
+		key := "mailto:" + strings.ToLower(s.Address)
+		due := s.Digest.lastDue(now)
+
+		stateMu.Lock()
+		last := state.LastDigest[key]
+		state.LastDigest[key] = due
+		unsubscribed := unsubscribedLocked(s.Address)
+		if last.Before(due) {
+			saveStateLocked()
+		}
+		stateMu.Unlock()
+		if !last.Before(due) || unsubscribed {
+			continue
+		}
+		if now.Sub(due) > digestGracePeriod {
+			announceLog.Warn("Skipping late mail digest", "to", s.Address, "due", due)
+			continue
+		}
+
+		var evs []prEvent
+		for _, ev := range eventsSince(due.Add(-s.Digest.length()), due) {
+			if s.wants(&ev) {
+				evs = append(evs, ev)
+			}
+		}
+		if len(evs) == 0 {
+			continue
+		}
+		stateMu.Lock()
+		queueMailLocked(&queuedMail{To: s.Address, Events: evs, Digest: s.Digest.Period, Created: now})
+		saveStateLocked()
+		stateMu.Unlock()
+	}
+}
+
+// unsubscribeToken signs address for its unsubscribe link.
+func unsubscribeToken(secret, address string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.ToLower(address)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func unsubscribeLink(ec *EmailConfig, address string) string {
+	return ec.UnsubscribeURL + "?" + url.Values{
+		"address": {address},
+		"token":   {unsubscribeToken(ec.UnsubscribeSecret, address)},
+	}.Encode()
+}
+
+// mailDomain is the domain of the From address, for Message-IDs.
+func mailDomain(ec *EmailConfig) string {
+	return ec.from.Address[strings.LastIndex(ec.from.Address, "@")+1:]
+}
+
+// composeMail builds the message for qm, headers and quoted-printable
+// body.
+func composeMail(ec *EmailConfig, qm *queuedMail) []byte {
+	var subject string
+	var body strings.Builder
+	ev := &qm.Events[0]
+	if qm.Digest == "" {
+		subject = fmt.Sprintf("PR/%d %s: %s", ev.Number, ev.Category, ev.Synopsis)
+		if ev.Kind == eventState {
+			subject = "Re: " + subject
+		}
+		fmt.Fprintf(&body, "%s\n\n%s\n%s\n", eventTitle(ev), eventSummary(ev), toGnatsUrl(ev.Number))
+	} else {
+		var counts digestCounts
+		for i := range qm.Events {
+			counts.add(qm.Events[i])
+		}
+		title := strings.ToUpper(qm.Digest[:1]) + qm.Digest[1:]
+		subject = fmt.Sprintf("%s GNATS digest: %s", title, counts)
+		for i := range qm.Events {
+			fmt.Fprintf(&body, "%s\n  %s\n", eventTitle(&qm.Events[i]), toGnatsUrl(qm.Events[i].Number))
+		}
+	}
+
+	link := unsubscribeLink(ec, qm.To)
+	fmt.Fprintf(&body, "\n-- \nYou get this because %s is subscribed to GNATS PR events.\n", qm.To)
+	fmt.Fprintf(&body, "Unsubscribe: %s\n", link)
+
+	var msg bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", name, value)
+	}
+	header("From", ec.from.String())
+	header("To", qm.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	// The mail about a new PR starts its thread, the others answer it.
+	if qm.Digest == "" && ev.Kind == eventNew {
+		header("Message-ID", prMessageID(mailDomain(ec), ev.Number))
+	} else {
+		to := sha256.Sum256([]byte(strings.ToLower(qm.To)))
+		header("Message-ID", fmt.Sprintf("<gnatsirc.%d.%d.%x@%s>", ev.Number, qm.Created.UnixNano(), to[:4], mailDomain(ec)))
+	}
+	if qm.Digest == "" && ev.Kind == eventState {
+		header("In-Reply-To", prMessageID(mailDomain(ec), ev.Number))
+		header("References", prMessageID(mailDomain(ec), ev.Number))
+	}
+	if qm.Digest == "" {
+		header("X-GNATS-Category", mime.QEncoding.Encode("utf-8", ev.Category))
+		header("X-GNATS-State", mime.QEncoding.Encode("utf-8", ev.NewState))
+	}
+	header("List-Id", "GNATS PR events <gnatsirc."+mailDomain(ec)+">")
+	header("List-Unsubscribe", "<"+link+">")
+	header("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	header("Auto-Submitted", "auto-generated")
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	msg.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(strings.Replace(body.String(), "\n", "\r\n", -1)))
+	qp.Close()
+	return msg.Bytes()
+}
+
+// sendMail delivers msg over SMTP: STARTTLS when offered, then AUTH PLAIN
+// if a username is configured.
+func sendMail(ec *EmailConfig, to string, msg []byte) error {
+	host, _, _ := net.SplitHostPort(ec.Server)
+	conn, err := net.DialTimeout("tcp", ec.Server, mailTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(mailTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := &tls.Config{ServerName: host}
+		if ec.tls != nil {
+			config = ec.tls.Clone()
+		}
+		if err := c.StartTLS(config); err != nil {
+			return fmt.Errorf("STARTTLS: %v", err)
+		}
+	} else if ec.Username != "" {
+		return fmt.Errorf("%s doesn't offer STARTTLS, not sending the password in the clear", ec.Server)
+	}
+	if ec.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", ec.Username, ec.Password, host)); err != nil {
+			return fmt.Errorf("AUTH: %v", err)
+		}
+	}
+	if err := c.Mail(ec.from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// dueMails returns the mails to send now, dropping those that are too old
+// or whose subscriber unsubscribed.
+func dueMails(now time.Time) []*queuedMail {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	var due []*queuedMail
+	kept := state.Mail[:0]
+	for _, qm := range state.Mail {
+		switch {
+		case unsubscribedLocked(qm.To):
+		case now.Sub(qm.Created) > mailMaxAge:
+			botLog.Warn("Giving up on mail", "to", qm.To, "attempts", qm.Attempts)
+		default:
+			kept = append(kept, qm)
+			if !now.Before(qm.NextTry) {
+				due = append(due, qm)
+			}
+		}
+	}
+	if len(kept) != len(state.Mail) {
+		state.Mail = kept
+		saveStateLocked()
+	}
+	return due
+}
+
+// finishMail removes qm from the queue after it was sent, or schedules
+// the next attempt.
+func finishMail(qm *queuedMail, err error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if err == nil {
+		for i, q := range state.Mail {
+			if q == qm {
+				state.Mail = append(state.Mail[:i], state.Mail[i+1:]...)
+				break
+			}
+		}
+	} else {
+		qm.Attempts++
+		delay := mailRetryDelay
+		for i := 1; i < qm.Attempts && delay < mailMaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > mailMaxDelay {
+			delay = mailMaxDelay
+		}
+		qm.NextTry = time.Now().Add(jitter(delay))
+		botLog.Warn("Sending mail failed", "to", qm.To, "attempts", qm.Attempts, "retry_in", delay, "err", err)
+	}
+	saveStateLocked()
+}
+
+// runMail queues digests as they come due and sends queued mails, oldest
+// first.
+func runMail() {
+	for sleep(mailCheckInterval) {
+		ec := getConfig().Email
+		if ec == nil {
+			continue
+		}
+		// A dry run leaves the digests due and the mails queued to the
+		// real bot.
+		var due []*queuedMail
+		if !isDryRun() {
+			queueMailDigests(ec, time.Now())
+			due = dueMails(time.Now())
+		}
+		for _, qm := range due {
+			if isStopping() {
+				return
+			}
+			err := sendMail(ec, qm.To, composeMail(ec, qm))
+			if err == nil {
+				announceLog.Debug("Sent mail", "to", qm.To, "events", len(qm.Events))
+			}
+			finishMail(qm, err)
+		}
+		watcherSucceeded("mail")
+	}
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<title>Unsubscribe</title>
+{{if .Done}}<p>{{.Address}} won't get GNATS PR mails anymore.</p>
+{{else}}<form method="post">
+<p>Stop GNATS PR mails to {{.Address}}?</p>
+<input type="hidden" name="address" value="{{.Address}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<button>Unsubscribe</button>
+</form>
+{{end}}`))
+
+// handleUnsubscribe serves the links in mails. GET asks to confirm, so
+// link checkers don't unsubscribe anyone; POST, also sent by one click
+// unsubscribing mail clients, unsubscribes.
+func handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	ec := getConfig().Email
+	if ec == nil || ec.UnsubscribeSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	address, token := r.FormValue("address"), r.FormValue("token")
+	if !hmac.Equal([]byte(token), []byte(unsubscribeToken(ec.UnsubscribeSecret, address))) {
+		http.Error(w, "Bad unsubscribe link", http.StatusForbidden)
+		return
+	}
+
+	done := false
+	switch r.Method {
+	case "GET":
+	case "POST":
+		stateMu.Lock()
+		state.Unsubscribed[strings.ToLower(address)] = time.Now()
+		saveStateLocked()
+		stateMu.Unlock()
+		botLog.Info("Unsubscribed from mail", "address", address)
+		done = true
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	unsubscribePage.Execute(w, map[string]interface{}{"Address": address, "Token": token, "Done": done})
+}
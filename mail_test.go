@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSession is what a client did on the fake SMTP server.
+type smtpSession struct {
+	tls      bool
+	auth     string
+	from, to string
+	data     string
+}
+
+// fakeSMTP serves one SMTP session, offering STARTTLS with config if it
+// isn't nil, and sends what happened on the returned channel.
+func fakeSMTP(t *testing.T, config *tls.Config) (addr string, session <-chan *smtpSession) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan *smtpSession, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		s := &smtpSession{}
+		defer func() { done <- s }()
+		r, w := bufio.NewReader(conn), conn
+		reply := func(line string) { w.Write([]byte(line + "\r\n")) }
+		reply("220 fake ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch {
+			case verb == "EHLO":
+				reply("250-fake")
+				if config != nil && !s.tls {
+					reply("250-STARTTLS")
+				}
+				reply("250 AUTH PLAIN")
+			case verb == "STARTTLS" && config != nil:
+				reply("220 go ahead")
+				tc := tls.Server(conn, config)
+				if err := tc.Handshake(); err != nil {
+					return
+				}
+				s.tls = true
+				r, w = bufio.NewReader(tc), tc
+			case verb == "AUTH":
+				fields := strings.Fields(line)
+				data, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+				s.auth = string(data)
+				reply("235 ok")
+			case verb == "MAIL":
+				s.from = line[len("MAIL FROM:"):]
+				reply("250 ok")
+			case verb == "RCPT":
+				s.to = line[len("RCPT TO:"):]
+				reply("250 ok")
+			case verb == "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				s.data = data.String()
+				reply("250 queued")
+			case verb == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 no")
+			}
+		}
+	}()
+	return l.Addr().String(), done
+}
+
+// testTLS is a server config and a client config trusting it.
+func testTLS() (server, client *tls.Config, close func()) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	return &tls.Config{Certificates: srv.TLS.Certificates},
+		&tls.Config{RootCAs: roots, ServerName: "127.0.0.1"},
+		srv.Close
+}
+
+func testEmailConfig(t *testing.T, server string) *EmailConfig {
+	ec := &EmailConfig{
+		Server:            server,
+		Username:          "bot",
+		Password:          "hunter2",
+		From:              "GNATS bot <gnats-bot@example.org>",
+		UnsubscribeURL:    "https://bot.example.org/unsubscribe",
+		UnsubscribeSecret: "secret",
+		Subscribers:       []*EmailSubscriber{{Address: "Alice <Alice@Example.org>"}},
+	}
+	if err := ec.parse(); err != nil {
+		t.Fatal(err)
+	}
+	return ec
+}
+
+func TestEmailConfigParse(t *testing.T) {
+	ec := testEmailConfig(t, "127.0.0.1:587")
+	if ec.Subscribers[0].Address != "Alice@Example.org" {
+		t.Errorf("subscriber address = %q", ec.Subscribers[0].Address)
+	}
+	if d := mailDomain(ec); d != "example.org" {
+		t.Errorf("mailDomain = %q", d)
+	}
+
+	for _, from := range []string{"", "gnats-bot", "GNATS bot <gnats-bot@example.org", "a@b, c@d"} {
+		ec := &EmailConfig{Server: "localhost:25", From: from, UnsubscribeURL: "u", UnsubscribeSecret: "s"}
+		if err := ec.parse(); err == nil {
+			t.Errorf("from %q accepted", from)
+		}
+	}
+	ec = &EmailConfig{Server: "localhost:25", From: "a@b", UnsubscribeURL: "u", UnsubscribeSecret: "s",
+		Subscribers: []*EmailSubscriber{{Address: "not an address"}}}
+	if err := ec.parse(); err == nil {
+		t.Error("bad subscriber address accepted")
+	}
+}
+
+func TestSendMailSTARTTLS(t *testing.T) {
+	server, client, closeTLS := testTLS()
+	defer closeTLS()
+	addr, session := fakeSMTP(t, server)
+	ec := testEmailConfig(t, addr)
+	ec.tls = client
+
+	if err := sendMail(ec, "alice@example.org", []byte("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	s := <-session
+	if !s.tls {
+		t.Error("STARTTLS not used")
+	}
+	if s.auth != "\x00bot\x00hunter2" {
+		t.Errorf("AUTH PLAIN sent %q", s.auth)
+	}
+	if s.from != "<gnats-bot@example.org>" || s.to != "<alice@example.org>" {
+		t.Errorf("envelope from %s to %s", s.from, s.to)
+	}
+	if s.data != "Subject: hi\r\n\r\nhello\r\n" {
+		t.Errorf("data = %q", s.data)
+	}
+}
+
+func TestSendMailWithoutSTARTTLS(t *testing.T) {
+	addr, session := fakeSMTP(t, nil)
+	ec := testEmailConfig(t, addr)
+
+	err := sendMail(ec, "alice@example.org", []byte("Subject: hi\r\n\r\nhello\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("err = %v, want a STARTTLS error", err)
+	}
+	if s := <-session; s.auth != "" || s.data != "" {
+		t.Errorf("sent the password or mail in the clear: %+v", s)
+	}
+}
+
+func TestComposeMail(t *testing.T) {
+	ec := testEmailConfig(t, "127.0.0.1:587")
+	ev := prEvent{Kind: eventNew, Number: 55555, Category: "kern", Synopsis: "panic in über", NewState: "open"}
+
+	read := func(qm *queuedMail) (*mail.Message, string) {
+		msg, err := mail.ReadMessage(strings.NewReader(string(composeMail(ec, qm))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg, string(body)
+	}
+
+	msg, body := read(&queuedMail{To: "alice@example.org", Events: []prEvent{ev}, Created: time.Now()})
+	link := unsubscribeLink(ec, "alice@example.org")
+	for name, want := range map[string]string{
+		"From":                  `"GNATS bot" <gnats-bot@example.org>`,
+		"To":                    "alice@example.org",
+		"Message-ID":            "<pr-55555@example.org>",
+		"In-Reply-To":           "",
+		"X-GNATS-Category":      "kern",
+		"List-Unsubscribe":      "<" + link + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	} {
+		if got := msg.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != "PR/55555 kern: panic in über" {
+		t.Errorf("Subject = %q", subject)
+	}
+	if !strings.Contains(body, "Unsubscribe: "+link+"\r\n") {
+		t.Errorf("body lacks the unsubscribe link:\n%s", body)
+	}
+
+	ev.Kind, ev.OldState, ev.NewState = eventState, "open", "closed"
+	msg, _ = read(&queuedMail{To: "alice@example.org", Events: []prEvent{ev}, Created: time.Now()})
+	if id := msg.Header.Get("Message-ID"); !strings.HasSuffix(id, "@example.org>") {
+		t.Errorf("state mail Message-ID = %q", id)
+	}
+	if got := msg.Header.Get("In-Reply-To"); got != "<pr-55555@example.org>" {
+		t.Errorf("state mail In-Reply-To = %q", got)
+	}
+
+	// Header values from GNATS can't add headers.
+	ev.NewState = "closed\r\nBcc: mallory@example.org"
+	msg, _ = read(&queuedMail{To: "alice@example.org", Events: []prEvent{ev}, Created: time.Now()})
+	if got := msg.Header.Get("Bcc"); got != "" {
+		t.Errorf("Bcc = %q", got)
+	}
+	if state, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("X-GNATS-State")); state != ev.NewState {
+		t.Errorf("X-GNATS-State = %q", state)
+	}
+
+	msg, _ = read(&queuedMail{To: "alice@example.org", Events: []prEvent{ev}, Digest: "daily", Created: time.Now()})
+	if got := msg.Header.Get("In-Reply-To") + msg.Header.Get("X-GNATS-Category"); got != "" {
+		t.Errorf("digest has per-PR headers: %q", got)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	ec := testEmailConfig(t, "127.0.0.1:587")
+	old := getConfig()
+	setConfig(&Config{Email: ec})
+	defer setConfig(old)
+	defer func() {
+		stateMu.Lock()
+		state = newBotState()
+		stateMu.Unlock()
+	}()
+
+	ev := prEvent{Kind: eventNew, Number: 1, Category: "kern"}
+	queueMails(&ev, nil)
+	if due := dueMails(time.Now()); len(due) != 1 || due[0].To != "Alice@Example.org" {
+		t.Fatalf("queued %v", due)
+	}
+
+	link, err := url.Parse(unsubscribeLink(ec, "Alice@Example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, query string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/unsubscribe?"+query, nil)
+		handleUnsubscribe(w, r)
+		return w.Code
+	}
+	bad := url.Values{"address": {"Alice@Example.org"}, "token": {"00"}}.Encode()
+	if code := serve("POST", bad); code != http.StatusForbidden {
+		t.Errorf("bad token: %d", code)
+	}
+	// Link checkers only GET.
+	if code := serve("GET", link.RawQuery); code != http.StatusOK {
+		t.Errorf("GET: %d", code)
+	}
+	if due := dueMails(time.Now()); len(due) != 1 {
+		t.Error("GET unsubscribed")
+	}
+	if code := serve("POST", link.RawQuery); code != http.StatusOK {
+		t.Errorf("POST: %d", code)
+	}
+
+	// The queued mail is dropped, and no more are queued.
+	if due := dueMails(time.Now()); len(due) != 0 {
+		t.Errorf("still due after unsubscribing: %v", due)
+	}
+	queueMails(&ev, nil)
+	stateMu.Lock()
+	queued := len(state.Mail)
+	stateMu.Unlock()
+	if queued != 0 {
+		t.Errorf("%d mails queued after unsubscribing", queued)
+	}
+}
+
+func TestDryRunMails(t *testing.T) {
+	old := getConfig()
+	setConfig(&Config{Email: testEmailConfig(t, "127.0.0.1:587")})
+	defer setConfig(old)
+	pending := &queuedMail{To: "bob@example.org"}
+	stateMu.Lock()
+	oldState := state
+	state = newBotState()
+	state.Mail = []*queuedMail{pending}
+	stateMu.Unlock()
+	defer func() {
+		stateMu.Lock()
+		state = oldState
+		stateMu.Unlock()
+	}()
+	defer withDryRun()()
+
+	pr := &PR{Number: 55501, Category: "bin", Synopsis: "ls is slow"}
+	queueMails(&prEvent{Kind: eventNew, Number: pr.Number, Category: pr.Category}, pr)
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if len(state.Mail) != 1 || state.Mail[0] != pending {
+		t.Errorf("queue changed in a dry run: %+v", state.Mail)
+	}
+}
@@ -4,14 +4,14 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io/ioutil"
-	"log"
-	"net"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/irc.v3"
@@ -19,6 +19,11 @@ import (
 
 const (
 	PRStartScan = 59240
+
+	// gnatsTimeout bounds a fetch from GNATS. Lookups are made while
+	// handling a message, and a hung one would keep the connection from
+	// ever being torn down.
+	gnatsTimeout = 30 * time.Second
 )
 
 var (
@@ -27,11 +32,45 @@ var (
 	ircServer         *string
 	ircUsername       *string
 	ircPassword       string
+	configFile        *string
+	stateFilePath     *string
+	connectTimeout    *time.Duration
+	pingFrequency     *time.Duration
+	pingTimeout       *time.Duration
+	maxLag            *time.Duration
+	quitMessage       *string
+	httpListen        *string
+	healthTimeout     *time.Duration
+	controlSocket     *string
+	dryRun            *bool
+	logLevelFlag      *string
+	logLevelsFlag     *string
+	logFormat         *string
+	logContent        *bool
+	debug             *bool
+)
+
+var startTime = time.Now()
+
+// The client of the current connection, nil while disconnected. Background
+// jobs outlive connections and look it up whenever they have something
+// to send.
+var (
+	clientMu  sync.Mutex
+	ircClient *irc.Client
+
+	// handlerMu makes messages from IRC, Matrix and the console be
+	// handled one at a time, like the IRC client's own reader does.
+	handlerMu sync.Mutex
 )
 
 type categorySlice []string
 
-const ctcpVersionReply = "Code available at https://github.com/coypoop/gnatsirc/"
+const (
+	sourceURL        = "https://github.com/coypoop/gnatsirc/"
+	ctcpVersionReply = "Code available at " + sourceURL
+	realName         = "GNATS urls on demand"
+)
 
 func (i *categorySlice) String() string {
 	return "my string representation"
@@ -43,10 +82,33 @@ func (i *categorySlice) Set(value string) error {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if sub, ok := subcommands[os.Args[1]]; ok {
+			sub(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Var(&allowedCategories, "allow-category", "Only post PRs from these categories.")
-	ircServer = flag.String("irc-server", "irc-server", "Which IRC server to connect, for example irc.example.com:6667")
+	ircServer = flag.String("irc-server", "irc-server", "Which IRC server to connect, for example irc.example.com:6667. Separate several with commas to rotate through them")
+	connectTimeout = flag.Duration("connect-timeout", 30*time.Second, "How long to wait for a connection to the IRC server")
+	pingFrequency = flag.Duration("ping-frequency", time.Minute, "How often to PING the server to check the connection is alive, 0 to disable")
+	pingTimeout = flag.Duration("ping-timeout", 2*time.Minute, "Reconnect when a PING isn't answered within this time. Use -ping-frequency 0 to disable PINGs")
+	maxLag = flag.Duration("max-lag", 30*time.Second, "Reconnect when a PING takes longer than this to be answered, 0 to disable")
 	ircChannel = flag.String("irc-channel", "irc-channel", "Which IRC channel to join, for example #my-channel")
 	ircUsername = flag.String("irc-username", "irc-username", "Which username to use on IRC")
+	configFile = flag.String("config", "", "JSON file with per-channel configuration, instead of -irc-channel")
+	quitMessage = flag.String("quit-message", "Shutting down", "QUIT message to leave with when stopped with SIGINT or SIGTERM")
+	httpListen = flag.String("http-listen", "", "Address to serve /metrics, /healthz, Atom feeds and the JSON API on, for example localhost:9101. Empty disables HTTP")
+	healthTimeout = flag.Duration("health-timeout", 15*time.Minute, "Fail /healthz when IRC or GNATS has been unreachable for longer than this")
+	controlSocket = flag.String("control-socket", "", "Unix socket for \"gnatsirc ctl\" to control the bot through, like gnatsirc.sock. Empty disables it")
+	logLevelFlag = flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	logLevelsFlag = flag.String("log-levels", "", "Per subsystem log levels, for example irc=debug,gnats=warn. Subsystems are irc, raw, gnats, announce, audit, matrix and bot")
+	logFormat = flag.String("log-format", "text", "Log format: text or json")
+	logContent = flag.Bool("log-content", false, "Log what people say in channels, which is redacted by default")
+	debug = flag.Bool("debug", false, "Log at debug level, including all IRC traffic")
+	dryRun = flag.Bool("dry-run", false, "Log what would be said in channels and to users instead of saying it")
+	stateFilePath = flag.String("state-file", "gnatsirc-state.json", "Where to remember tracked PRs between restarts")
 	ircPassword = os.Getenv("IRC_PASSWORD")
 
 	flag.Parse()
@@ -59,95 +121,148 @@ func main() {
 	if len(os.Args) < 4 {
 		usage()
 	}
+	if err := checkPingFlags(*pingFrequency, *pingTimeout); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		usage()
+	}
+
+	if err := setupLogging(*logLevelFlag, *logLevelsFlag, *logFormat, *logContent, *debug); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		usage()
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		botLog.Fatal("Cannot load config", "err", err)
+	}
+	setConfig(cfg)
+	if err := loadState(*stateFilePath); err != nil {
+		botLog.Fatal("Cannot load state", "err", err)
+	}
+
+	if isDryRun() {
+		divert = func(m *irc.Message) {
+			announceLog.Info("Dry run, not sending", "command", m.Command, "target", m.Params[0], "text", m.Trailing())
+		}
+	}
 
-	config := irc.ClientConfig{
+	go runSendQueue()
+	go handleSignals()
+	if *httpListen != "" {
+		go serveHTTP(*httpListen)
+	}
+	if *controlSocket != "" {
+		go serveControl(*controlSocket)
+	}
+	watch(runNickRecovery)
+	watch(observeNewPRs)
+	watch(observeStateChanges)
+	watch(runDigests)
+	watch(runStaleReminders)
+	watch(runChannelMaintenance)
+	watch(runWebhooks)
+	if cfg.Email != nil {
+		watch(runMail)
+	}
+	if cfg.Matrix != nil {
+		watch(runMatrixSync)
+		watch(runMatrixSender)
+	}
+
+	clientConfig := irc.ClientConfig{
 		Nick: *ircUsername,
 		Pass: ircPassword,
 		User: *ircUsername,
-		Name: "GNATS urls on demand",
-		Handler: irc.HandlerFunc(func(c *irc.Client, m *irc.Message) {
-			if m.Command == "001" {
-				log.Printf("Connected to server %s", *ircServer)
-				// 001 is a welcome event, so we identify join channels now
-				if ircPassword != "" {
-					log.Printf("Give the server a moment before authenticating")
-					time.Sleep(10 * time.Second)
-					log.Printf("Trying to authenticate")
-					c.WriteMessage(&irc.Message{
-						Command: "PRIVMSG",
-						Params: []string{
-							"NickServ",
-							"IDENTIFY " + *ircUsername + " " + ircPassword,
-						},
-					})
-				}
-				c.Write("JOIN " + *ircChannel)
-				log.Printf("Joined %s", *ircChannel)
-				go observeNewPRs(c, *ircChannel)
-			} else if m.Command == "PRIVMSG" && c.FromChannel(m) {
-				log.Printf("%v", m)
-				if selfMsg(m.Trailing()) {
-					return
-				}
-				prNum, err := findPR(m.Trailing())
-				if err == nil {
-
-					prUrl := toGnatsUrl(prNum)
-					prText, err := getPRText(prUrl)
-					if err != nil {
-						return
-					}
-					prSynopsis, err := findPRSynopsis(prText)
-					if err != nil {
-						return
-					}
-					prState, err := findPRState(prText)
-					if err != nil {
-						return
-					}
-					prCategory, err := findPRCategory(prText)
-					if err != nil {
-						return
-					}
-					outText := fmt.Sprintf("[%s] %s (%s) %s",
-						prState, prUrl, prCategory, prSynopsis)
-
-					c.WriteMessage(&irc.Message{
-						Command: "PRIVMSG",
-						Params: []string{
-							m.Params[0],
-							outText,
-						},
-					})
-				}
-			} else if isCTCP(m) {
-				requestingUser := m.Prefix.Name
-				switch ctcpType(m) {
-				case "VERSION":
-					c.WriteMessage(ctcpReply(requestingUser, "VERSION", ctcpVersionReply))
-					break
-				default:
-					break
-				}
-			} else {
-				log.Printf("%v", m)
-			}
-		}),
+		Name: realName,
+
+		PingFrequency: *pingFrequency,
+		PingTimeout:   *pingTimeout,
+
+		Handler: irc.HandlerFunc(handleMessage),
 	}
 
-	for {
-		conn, err := net.Dial("tcp", *ircServer)
-		if err != nil {
-			time.Sleep(1 * time.Minute)
-			continue
-		}
+	connectForever(clientConfig, *connectTimeout)
+	finishShutdown()
+}
 
-		client := irc.NewClient(conn, config)
-		err = client.Run()
-		if err != nil {
-			log.Println(err)
-		}
+// isDryRun reports whether -dry-run was given: nothing is said, posted or
+// mailed, only logged.
+func isDryRun() bool {
+	return dryRun != nil && *dryRun
+}
+
+// handleMessage handles every message from the server.
+func handleMessage(c *irc.Client, m *irc.Message) {
+	handlerMu.Lock()
+	defer handlerMu.Unlock()
+
+	countMessageIn()
+	trackSelf(c, m)
+	trackLag(m)
+	trackNames(c, m)
+	trackDevelopers(m)
+	trackSubscribers(m)
+	trackNickServ(c, m)
+	trackChannels(c, m)
+	trackAccounts(m)
+
+	if m.Command == "001" {
+		ircLog.Info("Connected", "server", m.Prefix.Name)
+		setCurrentClient(c)
+		// 001 is a welcome event, so we identify and join
+		// channels now
+		onWelcome(c)
+	} else if isCTCP(m) && ctcpType(m) != "ACTION" {
+		handleCTCP(c, m)
+	} else if m.Command == "PRIVMSG" && handleCommand(c, m) {
+		return
+	} else if m.Command == "PRIVMSG" && c.FromChannel(m) {
+		text := messageText(m)
+		ircLog.Debug("Channel message", "channel", m.Params[0], "from", m.Prefix.Name, "text", chatText(text))
+		answerPR(c, m.Params[0], text)
+	} else {
+		ircLog.Debug("Unhandled message", "message", m)
+	}
+}
+
+// answerPR looks up the PR referred to in text, said in channel, and
+// says what it is. IRC channels and Matrix rooms share it.
+func answerPR(c *irc.Client, channel, text string) {
+	if selfMsg(text) {
+		return
+	}
+	prNum, err := findPR(text)
+	if err != nil {
+		return
 	}
+	pr, err := fetchPR(prNum)
+	if err == errNoSuchPR {
+		countLookup(lookupNotFound)
+		return
+	} else if err != nil {
+		countLookup(lookupError)
+		gnatsLog.Warn("Lookup failed", "pr", prNum, "err", err)
+		return
+	}
+	countLookup(lookupFound)
+	if ev := trackPR(pr, false); ev != nil {
+		publish(ev, pr)
+	}
+	outText := formatPR(channel, formatLookup, pr)
+
+	say(c, priorityReply, channel, outText)
+}
+
+func setCurrentClient(c *irc.Client) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	ircClient = c
+}
+
+func currentClient() *irc.Client {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	return ircClient
 }
 
 func prExists(prNum int) bool {
@@ -173,12 +288,12 @@ func findLatestGoodPR() int {
 	for {
 		currentPR++
 		if prExists(currentPR) {
-			log.Printf("PR number %d exists, resetting bad PR count", currentPR)
+			gnatsLog.Debug("PR exists, resetting bad PR count", "pr", currentPR)
 			latestGoodPR = currentPR
 			badPRs = 0
 		} else {
 			badPRs++
-			log.Printf("PR number %d doesn't exist, bad PR count: %d", currentPR, badPRs)
+			gnatsLog.Debug("PR doesn't exist", "pr", currentPR, "bad_prs", badPRs)
 		}
 		if badPRs > 5 {
 			return latestGoodPR
@@ -187,76 +302,55 @@ func findLatestGoodPR() int {
 
 }
 
-func observeNewPRs(c *irc.Client, ircChan string) {
-	type PrData struct {
-		Synopsis string
-		Category string
-	}
+// rescanFrom makes observeNewPRs look for new PRs from another number,
+// and pollNow makes it look right away.
+var (
+	rescanFrom = make(chan int, 1)
+	pollNow    = make(chan struct{}, 1)
+)
+
+func observeNewPRs() {
 	latestGoodPR := findLatestGoodPR()
+	noteLatestPR(latestGoodPR)
 	startPR := latestGoodPR + 1
-	fmt.Printf("Starting to observe new PRs beginning with %d", startPR)
+	gnatsLog.Info("Observing new PRs", "from", startPR)
 	for {
-		prDatas := make(map[int]PrData)
 		for i := 0; i < 20; i++ {
 			currentPR := startPR + i
-			log.Printf("Checking out %d", currentPR)
-			prUrl := toGnatsUrl(currentPR)
-			prText, err := getPRText(prUrl)
+			gnatsLog.Debug("Checking out", "pr", currentPR)
+			pr, err := fetchPR(currentPR)
 			if err != nil {
-				log.Printf("getPRText returned err %+v for PR URL #%s", err, prUrl)
-				continue
-			}
-			currentSynopsis, err := findPRSynopsis(prText)
-			if err != nil {
-				log.Printf("findPRSynopsis returned err %v for PR %d (confidential/non-existent bug)", err, currentPR)
-				continue
-			}
-			currentCategory, err := findPRCategory(prText)
-			if err != nil {
-				log.Printf("findPRCategory returned err %+v for prText %s", err, prText)
-				continue
-			}
-			if !allowedCategory(currentCategory) {
-				log.Printf("category %s is not allowed", currentCategory)
+				gnatsLog.Debug("Cannot fetch PR, confidential or non-existent", "pr", currentPR, "err", err)
 				continue
 			}
 			latestGoodPR = currentPR
-			prDatas[currentPR] = PrData{
-				Synopsis: currentSynopsis,
-				Category: currentCategory,
+			noteLatestPR(currentPR)
+			if ev := trackPR(pr, true); ev != nil {
+				publish(ev, pr)
 			}
 		}
 
 		startPR = latestGoodPR + 1
-
-		if len(prDatas) > 5 {
-			log.Printf("Was going to post >5 new PR messages to chat, skipping")
-			log.Printf("Would have printed: %v", prDatas)
-			continue
-		}
-
-		for prNumber, prData := range prDatas {
-			outText := fmt.Sprintf("[new] %s (%s) %s",
-				toGnatsUrl(prNumber), prData.Category, prData.Synopsis)
-			c.WriteMessage(&irc.Message{
-				Command: "PRIVMSG",
-				Params: []string{
-					ircChan,
-					outText,
-				},
-			})
-
+		flushNewPRs()
+		watcherSucceeded("new_prs")
+		select {
+		case <-time.After(10 * time.Minute):
+		case from := <-rescanFrom:
+			gnatsLog.Info("Rescanning", "from", from)
+			startPR = from
+		case <-pollNow:
+		case <-stopping:
+			return
 		}
-		time.Sleep(10 * time.Minute)
 	}
 }
 
-func allowedCategory(testedCategory string) bool {
-	if allowedCategories == nil {
+func allowedCategory(ch *ChannelConfig, testedCategory string) bool {
+	if len(ch.Categories) == 0 {
 		return true
 	}
 
-	for _, allowedCategory := range allowedCategories {
+	for _, allowedCategory := range ch.Categories {
 		if testedCategory == allowedCategory {
 			return true
 		}
@@ -284,23 +378,37 @@ func isCTCP(m *irc.Message) bool {
 	if m.Command != "PRIVMSG" {
 		return false
 	}
-	message := m.Trailing()
-	if !strings.HasPrefix(message, ctcpDelimiter) {
-		return false
-	}
-	if !strings.HasSuffix(message, ctcpDelimiter) {
-		return false
+	return isCTCPText(m.Trailing())
+}
+
+// isCTCPText reports whether message is a CTCP message. Some clients
+// leave off the closing delimiter, which is allowed.
+func isCTCPText(message string) bool {
+	return len(message) > 1 && strings.HasPrefix(message, ctcpDelimiter)
+}
+
+// ctcpParse splits a CTCP message into its upper-cased type and arguments.
+func ctcpParse(m *irc.Message) (string, string) {
+	msg := m.Trailing()
+	msg = strings.TrimSuffix(strings.TrimPrefix(msg, ctcpDelimiter), ctcpDelimiter)
+	fields := strings.SplitN(msg, " ", 2)
+	args := ""
+	if len(fields) > 1 {
+		args = fields[1]
 	}
-	return true
+	return strings.ToUpper(fields[0]), args
 }
 
 func ctcpType(m *irc.Message) string {
-	msg := m.Trailing()
-	return strings.TrimSuffix(strings.TrimPrefix(msg, ctcpDelimiter), ctcpDelimiter)
+	t, _ := ctcpParse(m)
+	return t
 }
 
 func ctcpReply(user, ctcpType, reply string) *irc.Message {
-	ctcpEscapedReply := ctcpDelimiter + ctcpType + " " + reply + ctcpDelimiter
+	ctcpEscapedReply := ctcpDelimiter + ctcpType + ctcpDelimiter
+	if reply != "" {
+		ctcpEscapedReply = ctcpDelimiter + ctcpType + " " + reply + ctcpDelimiter
+	}
 	return &irc.Message{
 		Command: "NOTICE",
 		Params: []string{
@@ -318,17 +426,29 @@ func findFirstSubmatch(prText string, rgx *regexp.Regexp) (string, error) {
 	return rs[1], nil
 }
 
+var gnatsHTTP = &http.Client{Timeout: gnatsTimeout}
+
 func getPRText(prUrl string) (string, error) {
-	resp, err := http.Get(prUrl)
+	started := time.Now()
+	resp, err := gnatsHTTP.Get(prUrl)
 	if err != nil {
+		observeFetch(time.Since(started), err)
 		return "", err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil && resp.StatusCode != http.StatusNotFound && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		err = fmt.Errorf("%s: %s", prUrl, resp.Status)
+	}
+	// A 404 is GNATS answering, just not with a PR.
+	observeFetch(time.Since(started), err)
 	if err != nil {
 		return "", err
 	}
-	return undoHtmlSanitize(string(body)), nil
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errNoSuchPR
+	}
+	return undoHtmlSanitize(toUTF8(resp.Header.Get("Content-Type"), body)), nil
 }
 
 func findPRCategory(prText string) (string, error) {
@@ -358,19 +478,19 @@ func findPR(msg string) (int, error) {
 	return 0, errors.New("PR number not found")
 }
 
+// undoHtmlSanitize decodes all HTML entities, named and numeric.
 func undoHtmlSanitize(msg string) string {
-	msg = strings.ReplaceAll(msg, "&gt;", ">")
-	msg = strings.ReplaceAll(msg, "&lt;", "<")
-	msg = strings.ReplaceAll(msg, "&amp;", "&")
-	msg = strings.ReplaceAll(msg, "&quot;", `"`)
-
-	return msg
+	return html.UnescapeString(msg)
 }
 
 var prRegexps []*regexp.Regexp
 var synopsisRegexp *regexp.Regexp
 var categoryRegexp *regexp.Regexp
 var stateRegexp *regexp.Regexp
+var severityRegexp *regexp.Regexp
+var responsibleRegexp *regexp.Regexp
+var lastModifiedRegexp *regexp.Regexp
+var descriptionRegexp *regexp.Regexp
 var selfMsgRegexp *regexp.Regexp
 
 func init() {
@@ -378,6 +498,10 @@ func init() {
 	synopsisRegexp = regexp.MustCompile(`.*Synopsis:.... *(.*)`)
 	categoryRegexp = regexp.MustCompile(`.*Category:.... *(.*)`)
 	stateRegexp = regexp.MustCompile(`.*State:.... *(.*)`)
+	severityRegexp = regexp.MustCompile(`.*Severity:.... *(.*)`)
+	responsibleRegexp = regexp.MustCompile(`.*Responsible:.... *(.*)`)
+	lastModifiedRegexp = regexp.MustCompile(`.*Last-Modified:.... *(.*)`)
+	descriptionRegexp = regexp.MustCompile(`(?s)Description:....(.*?)(?:How-To-Repeat:|Fix:|Unformatted:|$)`)
 	prRegexps = []*regexp.Regexp{
 		regexp.MustCompile("PR [a-z]*/([0-9]{4,5})"),
 		regexp.MustCompile("PR ([0-9]{4,5})"),
@@ -392,8 +516,21 @@ func init() {
 	}
 }
 
+// checkPingFlags rejects a -ping-timeout that would drop every
+// connection: the irc library times out each PING it sends, and has no
+// way of sending PINGs without.
+func checkPingFlags(frequency, timeout time.Duration) error {
+	if frequency > 0 && timeout <= 0 {
+		return fmt.Errorf("-ping-timeout %v would time out every PING, use -ping-frequency 0 to disable PINGs", timeout)
+	}
+	return nil
+}
+
 func usage() {
-	fmt.Printf("Usage: [IRC_PASSWORD=password] \t%s -irc-server irc.example.com:6667 -irc-channel -irc-username gnat #netbsd [-allow-category pkg]\n", os.Args[0])
+	fmt.Printf("Usage: [IRC_PASSWORD=password] \t%s -irc-server irc.example.com:6667 -irc-channel -irc-username gnat #netbsd [-allow-category pkg] [-config gnatsirc.json]\n", os.Args[0])
+	fmt.Printf("   or: \t%s ctl -control-socket gnatsirc.sock <command>, to control a running bot\n", os.Args[0])
+	fmt.Printf("   or: \t%s lookup|scan|head|export ..., to query GNATS without IRC\n", os.Args[0])
+	fmt.Printf("   or: \t%s console [file], to try out lines as if said in channel\n", os.Args[0])
 	flag.PrintDefaults()
 	os.Exit(1)
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetPRTextStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("Synopsis: ls &amp; cat"))
+		case "/2":
+			http.NotFound(w, r)
+		default:
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	metrics.Lock()
+	before := metrics.fetchErrors
+	metrics.Unlock()
+	fetchErrors := func() int {
+		metrics.Lock()
+		defer metrics.Unlock()
+		return metrics.fetchErrors - before
+	}
+
+	if text, err := getPRText(srv.URL + "/1"); err != nil || text != "Synopsis: ls & cat" {
+		t.Errorf("200: %q, %v", text, err)
+	}
+	if _, err := getPRText(srv.URL + "/2"); err != errNoSuchPR {
+		t.Errorf("404: %v, want errNoSuchPR", err)
+	}
+	if n := fetchErrors(); n != 0 {
+		t.Errorf("%d fetch errors counted for 200 and 404", n)
+	}
+	if _, err := getPRText(srv.URL + "/3"); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("503: %v", err)
+	}
+	if n := fetchErrors(); n != 1 {
+		t.Errorf("%d fetch errors counted for 503", n)
+	}
+}
+
+func TestLatestPRMetric(t *testing.T) {
+	defer func(old int) {
+		metrics.Lock()
+		metrics.latestPR = old
+		metrics.Unlock()
+	}(latestPR())
+
+	noteLatestPR(60000)
+	// A rescan of older PRs doesn't lower it.
+	noteLatestPR(59300)
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	if !strings.Contains(buf.String(), "\ngnatsirc_latest_pr 60000\n") {
+		t.Errorf("metrics lack gnatsirc_latest_pr 60000:\n%s", buf.String())
+	}
+}
+
+func TestCheckPingFlags(t *testing.T) {
+	tests := []struct {
+		frequency, timeout time.Duration
+		ok                 bool
+	}{
+		{time.Minute, 2 * time.Minute, true},
+		{time.Minute, 0, false},
+		{time.Minute, -time.Second, false},
+		{0, 0, true},
+		{0, 2 * time.Minute, true},
+	}
+	for _, test := range tests {
+		if err := checkPingFlags(test.frequency, test.timeout); (err == nil) != test.ok {
+			t.Errorf("checkPingFlags(%v, %v) = %v", test.frequency, test.timeout, err)
+		}
+	}
+}
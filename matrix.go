@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+const (
+	// How long a sync waits on the homeserver for new events.
+	matrixSyncTimeout = 30 * time.Second
+	// Failed syncs are retried after matrixRetryDelay, doubling up to
+	// matrixMaxDelay.
+	matrixRetryDelay = 5 * time.Second
+	matrixMaxDelay   = 5 * time.Minute
+	// Messages waiting to be sent. More are dropped.
+	matrixQueueSize = 100
+	// A message that fails for other reasons than rate limiting is tried
+	// this often.
+	matrixSendAttempts = 3
+)
+
+// syncFilter keeps syncs down to room messages and memberships.
+const syncFilter = `{"presence":{"types":[]},"account_data":{"types":[]},` +
+	`"room":{"timeline":{"limit":50,"types":["m.room.message"]},"ephemeral":{"types":[]},"account_data":{"types":[]}}}`
+
+// MatrixConfig is the account the bot uses on a Matrix homeserver.
+type MatrixConfig struct {
+	// Homeserver is the base URL of the client-server API, like
+	// https://matrix.example.org.
+	Homeserver string `json:"homeserver"`
+	// UserID is the bot's full user ID, like @gnatsirc:example.org.
+	UserID string `json:"user_id"`
+	// AccessToken authenticates the bot. The MATRIX_ACCESS_TOKEN
+	// environment variable is used if it is empty.
+	AccessToken string `json:"access_token"`
+}
+
+func (mc *MatrixConfig) parse() error {
+	if mc.AccessToken == "" {
+		mc.AccessToken = os.Getenv("MATRIX_ACCESS_TOKEN")
+	}
+	switch {
+	case mc.Homeserver == "":
+		return errors.New("no homeserver")
+	case !strings.HasPrefix(mc.UserID, "@") || !strings.Contains(mc.UserID, ":"):
+		return fmt.Errorf("bad user_id %q", mc.UserID)
+	case mc.AccessToken == "":
+		return errors.New("no access_token")
+	}
+	mc.Homeserver = strings.TrimRight(mc.Homeserver, "/")
+	return nil
+}
+
+// matrixError is an error response of the homeserver.
+type matrixError struct {
+	Status     int    `json:"-"`
+	Code       string `json:"errcode"`
+	Message    string `json:"error"`
+	RetryAfter int    `json:"retry_after_ms"`
+}
+
+func (e *matrixError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+type matrixEvent struct {
+	Type     string          `json:"type"`
+	Sender   string          `json:"sender"`
+	StateKey *string         `json:"state_key"`
+	Content  json.RawMessage `json:"content"`
+}
+
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]struct {
+			InviteState struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"invite_state"`
+		} `json:"invite"`
+	} `json:"rooms"`
+}
+
+type matrixMessageContent struct {
+	MsgType   string `json:"msgtype"`
+	Body      string `json:"body"`
+	RelatesTo *struct {
+		InReplyTo *struct {
+			EventID string `json:"event_id"`
+		} `json:"m.in_reply_to"`
+	} `json:"m.relates_to"`
+	// Edits carry the new text here, and a "* " fallback in Body.
+	NewContent json.RawMessage `json:"m.new_content"`
+}
+
+// matrixOutgoing is a message waiting to be sent: target is a room ID,
+// alias or user ID. Retries keep the transaction ID, so the homeserver
+// drops duplicates.
+type matrixOutgoing struct {
+	target, text, txn string
+}
+
+var (
+	matrixHTTP = &http.Client{Timeout: matrixSyncTimeout + 30*time.Second}
+	matrixOut  = make(chan matrixOutgoing, matrixQueueSize)
+	matrixTxn  int64
+
+	// Joined rooms: room IDs by the name they are configured with, and
+	// back.
+	matrixMu    sync.Mutex
+	matrixRooms = make(map[string]string)
+	matrixNames = make(map[string]string)
+
+	// offlineClient stands in for the IRC client while it's not
+	// connected, so Matrix commands still work.
+	offlineClient = irc.NewClient(&consoleConn{Reader: strings.NewReader("")}, irc.ClientConfig{})
+)
+
+// clientFor is the client to send to target with: the IRC one, or
+// offlineClient for a Matrix target while IRC is down. It is nil for IRC
+// targets while disconnected.
+func clientFor(target string) *irc.Client {
+	if c := currentClient(); c != nil {
+		return c
+	}
+	if isMatrixTarget(target) {
+		return offlineClient
+	}
+	return nil
+}
+
+// isMatrixTarget reports whether name is a Matrix room ID, room alias or
+// user ID rather than an IRC channel or nick. IRC channel names can't
+// contain a colon.
+func isMatrixTarget(name string) bool {
+	return len(name) > 1 && strings.ContainsRune("!#@", rune(name[0])) && strings.Contains(name, ":")
+}
+
+// matrixRequest makes a client-server API call, encoding in and decoding
+// the response into out, either of which may be nil.
+func matrixRequest(ctx context.Context, method, path string, in, out interface{}) error {
+	mc := getConfig().Matrix
+	if mc == nil {
+		return errors.New("matrix isn't configured")
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, mc.Homeserver+"/_matrix/client/v3"+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+mc.AccessToken)
+	req.Header.Set("User-Agent", "gnatsirc (+"+sourceURL+")")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := matrixHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		merr := &matrixError{Status: resp.StatusCode}
+		json.Unmarshal(data, merr)
+		return merr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// matrixJoin joins a room by ID or alias and returns its ID.
+func matrixJoin(ctx context.Context, room string) (string, error) {
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	err := matrixRequest(ctx, "POST", "/join/"+url.PathEscape(room), struct{}{}, &resp)
+	return resp.RoomID, err
+}
+
+// joinMatrixRooms joins the configured rooms not joined yet.
+func joinMatrixRooms(ctx context.Context) {
+	for _, name := range getConfig().joinChannels() {
+		if !isMatrixTarget(name) || strings.HasPrefix(name, "@") {
+			continue
+		}
+		matrixMu.Lock()
+		_, joined := matrixRooms[strings.ToLower(name)]
+		matrixMu.Unlock()
+		if joined {
+			continue
+		}
+
+		id, err := matrixJoin(ctx, name)
+		if err != nil {
+			matrixLog.Warn("Cannot join room", "room", name, "err", err)
+			continue
+		}
+		matrixLog.Info("Joined room", "room", name, "id", id)
+		rememberMatrixRoom(name, id)
+	}
+}
+
+// rememberMatrixRoom records that the room called name, which the bot is
+// in, has the given ID.
+func rememberMatrixRoom(name, id string) {
+	matrixMu.Lock()
+	defer matrixMu.Unlock()
+	matrixRooms[strings.ToLower(name)] = id
+	matrixNames[id] = name
+}
+
+// matrixRoomName is the name a room is configured with, or its ID.
+func matrixRoomName(id string) string {
+	matrixMu.Lock()
+	defer matrixMu.Unlock()
+	if name, ok := matrixNames[id]; ok {
+		return name
+	}
+	return id
+}
+
+// matrixRoomID finds the room to send to target in, joining it or, for a
+// user, opening a direct chat if needed.
+func matrixRoomID(ctx context.Context, target string) (string, error) {
+	matrixMu.Lock()
+	id, ok := matrixRooms[strings.ToLower(target)]
+	matrixMu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	switch target[0] {
+	case '!':
+		return target, nil
+	case '#':
+		id, err := matrixJoin(ctx, target)
+		if err != nil {
+			return "", err
+		}
+		matrixLog.Info("Joined room", "room", target, "id", id)
+		rememberMatrixRoom(target, id)
+		return id, nil
+	}
+
+	stateMu.Lock()
+	id, ok = state.MatrixDMs[target]
+	stateMu.Unlock()
+	if ok {
+		return id, nil
+	}
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	err := matrixRequest(ctx, "POST", "/createRoom", map[string]interface{}{
+		"preset":    "trusted_private_chat",
+		"is_direct": true,
+		"invite":    []string{target},
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+	matrixLog.Info("Opened direct chat", "user", target, "id", resp.RoomID)
+	rememberMatrixDM(target, resp.RoomID)
+	return resp.RoomID, nil
+}
+
+func rememberMatrixDM(user, id string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state.MatrixDMs[user] = id
+	saveStateLocked()
+}
+
+// sendMatrix queues text to be sent to a Matrix room or user.
+func sendMatrix(target, text string) {
+	if divert != nil {
+		divert(&irc.Message{Command: "PRIVMSG", Params: []string{target, text}})
+		return
+	}
+	select {
+	case matrixOut <- matrixOutgoing{target, text, fmt.Sprintf("gnatsirc.%d.%d", startTime.UnixNano(), atomic.AddInt64(&matrixTxn, 1))}:
+	default:
+		matrixLog.Warn("Send queue full, dropping message", "target", target)
+	}
+}
+
+// mIRC palette colours as HTML, indexed like ircColors.
+var matrixColors = [...]string{
+	"#ffffff", "#000000", "#00007f", "#009300", "#ff0000", "#7f0000", "#9c009c", "#fc7f00",
+	"#ffff00", "#00fc00", "#009393", "#00ffff", "#0000fc", "#ff00ff", "#7f7f7f", "#d2d2d2",
+}
+
+var urlRegexp = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// matrixBody turns text with IRC formatting into a plain text body and
+// the HTML formatted body of a Matrix message.
+func matrixBody(text string) (plain, formatted string) {
+	var p, h strings.Builder
+	var bold, italic, underline bool
+	color := -1
+
+	open := func() {
+		if color >= 0 {
+			fmt.Fprintf(&h, `<font data-mx-color="%s" color="%s">`, matrixColors[color], matrixColors[color])
+		}
+		if bold {
+			h.WriteString("<b>")
+		}
+		if italic {
+			h.WriteString("<i>")
+		}
+		if underline {
+			h.WriteString("<u>")
+		}
+	}
+	close := func() {
+		if underline {
+			h.WriteString("</u>")
+		}
+		if italic {
+			h.WriteString("</i>")
+		}
+		if bold {
+			h.WriteString("</b>")
+		}
+		if color >= 0 {
+			h.WriteString("</font>")
+		}
+	}
+	run := func(s string) {
+		p.WriteString(s)
+		h.WriteString(urlRegexp.ReplaceAllString(html.EscapeString(s), `<a href="$0">$0</a>`))
+	}
+
+	start := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\x02', '\x1d', '\x1f', '\x0f', '\x03':
+		default:
+			continue
+		}
+		run(text[start:i])
+		close()
+		switch text[i] {
+		case '\x02':
+			bold = !bold
+		case '\x1d':
+			italic = !italic
+		case '\x1f':
+			underline = !underline
+		case '\x0f':
+			bold, italic, underline, color = false, false, false, -1
+		case '\x03':
+			color = -1
+			n, digits := 0, 0
+			for digits < 2 && i+1 < len(text) && text[i+1] >= '0' && text[i+1] <= '9' {
+				n = n*10 + int(text[i+1]-'0')
+				digits++
+				i++
+			}
+			if digits > 0 && n < len(matrixColors) {
+				color = n
+			}
+			// A background colour has no place in HTML bodies.
+			if digits > 0 && i+2 < len(text) && text[i+1] == ',' && text[i+2] >= '0' && text[i+2] <= '9' {
+				i += 2
+				if i+1 < len(text) && text[i+1] >= '0' && text[i+1] <= '9' {
+					i++
+				}
+			}
+		}
+		open()
+		start = i + 1
+	}
+	run(text[start:])
+	close()
+	return p.String(), h.String()
+}
+
+// postMatrix sends one message, as a notice as is usual for bots.
+func postMatrix(ctx context.Context, out matrixOutgoing) error {
+	id, err := matrixRoomID(ctx, out.target)
+	if err != nil {
+		return err
+	}
+	plain, formatted := matrixBody(out.text)
+	return matrixRequest(ctx, "PUT", "/rooms/"+url.PathEscape(id)+"/send/m.room.message/"+out.txn, map[string]string{
+		"msgtype":        "m.notice",
+		"body":           plain,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": formatted,
+	}, nil)
+}
+
+// runMatrixSender sends queued messages in order, waiting out rate
+// limits.
+func runMatrixSender() {
+	ctx := stoppingContext()
+	for {
+		var out matrixOutgoing
+		select {
+		case out = <-matrixOut:
+		case <-stopping:
+			return
+		}
+		if !deliverMatrix(ctx, out) {
+			return
+		}
+	}
+}
+
+// deliverMatrix sends out, retrying failures a few times and rate limits
+// until they pass. It returns false if we started shutting down.
+func deliverMatrix(ctx context.Context, out matrixOutgoing) bool {
+	limited := matrixRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := postMatrix(ctx, out)
+		if err == nil {
+			return true
+		}
+		var delay time.Duration
+		if merr, ok := err.(*matrixError); ok && merr.Status == http.StatusTooManyRequests {
+			// retry_after_ms is optional. Without it, back off.
+			delay = time.Duration(merr.RetryAfter) * time.Millisecond
+			if delay <= 0 {
+				delay = jitter(limited)
+				if limited *= 2; limited > matrixMaxDelay {
+					limited = matrixMaxDelay
+				}
+			}
+			attempt--
+		} else if attempt < matrixSendAttempts {
+			delay = matrixRetryDelay
+		}
+		if delay == 0 {
+			matrixLog.Warn("Cannot send message", "target", out.target, "err", err)
+			return true
+		}
+		if !sleep(delay) {
+			return false
+		}
+	}
+}
+
+// runMatrixSync reads the rooms the bot is in. Messages are answered like
+// those in IRC channels: commands, then PR references.
+func runMatrixSync() {
+	ctx := stoppingContext()
+	since := ""
+	delay := matrixRetryDelay
+	for !isStopping() {
+		joinMatrixRooms(ctx)
+
+		q := url.Values{"filter": {syncFilter}}
+		if since != "" {
+			q.Set("since", since)
+			q.Set("timeout", fmt.Sprint(matrixSyncTimeout.Milliseconds()))
+		}
+		var resp matrixSync
+		if err := matrixRequest(ctx, "GET", "/sync?"+q.Encode(), nil, &resp); err != nil {
+			if isStopping() {
+				return
+			}
+			matrixLog.Warn("Sync failed", "err", err, "retry_in", delay)
+			if !sleep(jitter(delay)) {
+				return
+			}
+			if delay *= 2; delay > matrixMaxDelay {
+				delay = matrixMaxDelay
+			}
+			continue
+		}
+		delay = matrixRetryDelay
+
+		acceptMatrixInvites(ctx, &resp)
+		// The first sync is history, which has been answered already.
+		if since != "" {
+			for id, room := range resp.Rooms.Join {
+				for _, ev := range room.Timeline.Events {
+					handleMatrixEvent(id, &ev)
+				}
+			}
+		}
+		since = resp.NextBatch
+		watcherSucceeded("matrix")
+	}
+}
+
+// acceptMatrixInvites joins direct chats users open with the bot. Other
+// invites are left alone; rooms are joined when configured.
+func acceptMatrixInvites(ctx context.Context, resp *matrixSync) {
+	self := getConfig().Matrix.UserID
+	for id, room := range resp.Rooms.Invite {
+		for _, ev := range room.InviteState.Events {
+			if ev.Type != "m.room.member" || ev.StateKey == nil || *ev.StateKey != self {
+				continue
+			}
+			var content struct {
+				IsDirect bool `json:"is_direct"`
+			}
+			json.Unmarshal(ev.Content, &content)
+			if !content.IsDirect {
+				matrixLog.Info("Ignoring invite", "room", id, "from", ev.Sender)
+				continue
+			}
+			if _, err := matrixJoin(ctx, id); err != nil {
+				matrixLog.Warn("Cannot accept invite", "room", id, "from", ev.Sender, "err", err)
+				continue
+			}
+			matrixLog.Info("Accepted direct chat", "user", ev.Sender, "id", id)
+			rememberMatrixDM(ev.Sender, id)
+		}
+	}
+}
+
+// stripReplyFallback removes the quote of the message replied to from
+// the body of a reply.
+func stripReplyFallback(body string) string {
+	lines := strings.Split(body, "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+		i++
+	}
+	if i > 0 && i < len(lines) && lines[i] == "" {
+		i++
+	}
+	return strings.Join(lines[i:], "\n")
+}
+
+// matrixPrefix is the IRC prefix standing for a Matrix user. The host
+// can't match IRC admin masks by accident.
+func matrixPrefix(user string) *irc.Prefix {
+	local, server := user, "matrix"
+	if i := strings.Index(user, ":"); i > 0 {
+		local, server = user[1:i], user[i+1:]
+	}
+	return &irc.Prefix{Name: user, User: local, Host: "matrix/" + server}
+}
+
+// handleMatrixEvent answers a message in a room. It is made into a
+// PRIVMSG tagged with the sender as account, so commands and admin
+// checks treat Matrix user IDs like NickServ accounts.
+func handleMatrixEvent(room string, ev *matrixEvent) {
+	if ev.Type != "m.room.message" || ev.Sender == getConfig().Matrix.UserID {
+		return
+	}
+	var content matrixMessageContent
+	if err := json.Unmarshal(ev.Content, &content); err != nil || content.MsgType != "m.text" || content.NewContent != nil {
+		return
+	}
+	body := content.Body
+	if content.RelatesTo != nil && content.RelatesTo.InReplyTo != nil {
+		body = stripReplyFallback(body)
+	}
+
+	name := matrixRoomName(room)
+	matrixLog.Debug("Room message", "room", name, "from", ev.Sender, "text", chatText(body))
+	m := &irc.Message{
+		Tags:    irc.Tags{"account": irc.TagValue(ev.Sender)},
+		Prefix:  matrixPrefix(ev.Sender),
+		Command: "PRIVMSG",
+		Params:  []string{name, body},
+	}
+	c := clientFor(name)
+	handlerMu.Lock()
+	handled := handleCommand(c, m)
+	handlerMu.Unlock()
+	if handled {
+		return
+	}
+	// Outside handlerMu, like the scans, so a slow GNATS holds up only
+	// Matrix and not IRC.
+	answerPR(c, name, body)
+}
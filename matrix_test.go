@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHomeserver points the Matrix client at handler until the returned
+// function is called.
+func fakeHomeserver(t *testing.T, handler http.HandlerFunc) func() {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("%s %s: Authorization = %q", r.Method, r.URL.Path, got)
+		}
+		handler(w, r)
+	}))
+	old := getConfig()
+	setConfig(&Config{Matrix: &MatrixConfig{
+		Homeserver:  srv.URL,
+		UserID:      "@gnatsirc:example.org",
+		AccessToken: "secret",
+	}})
+	return func() {
+		srv.Close()
+		setConfig(old)
+		matrixMu.Lock()
+		matrixRooms = make(map[string]string)
+		matrixNames = make(map[string]string)
+		matrixMu.Unlock()
+	}
+}
+
+func TestMatrixBody(t *testing.T) {
+	tests := []struct {
+		text, plain, formatted string
+	}{
+		{"plain", "plain", "plain"},
+		{"a <b> & c", "a <b> & c", "a &lt;b&gt; &amp; c"},
+		{"\x02bold\x02 text", "bold text", "<b>bold</b> text"},
+		{"\x1ditalic\x0f and \x1funderline", "italic and underline", "<i>italic</i> and <u>underline</u>"},
+		{"\x0304red\x03 plain", "red plain", `<font data-mx-color="#ff0000" color="#ff0000">red</font> plain`},
+		{"\x0304,01red on black", "red on black", `<font data-mx-color="#ff0000" color="#ff0000">red on black</font>`},
+		{"\x0399no colour", "no colour", "no colour"},
+		{"see https://gnats.netbsd.org/1", "see https://gnats.netbsd.org/1",
+			`see <a href="https://gnats.netbsd.org/1">https://gnats.netbsd.org/1</a>`},
+	}
+	for _, test := range tests {
+		plain, formatted := matrixBody(test.text)
+		if plain != test.plain || formatted != test.formatted {
+			t.Errorf("matrixBody(%q) = %q, %q, want %q, %q", test.text, plain, formatted, test.plain, test.formatted)
+		}
+	}
+}
+
+func TestMatrixSendRateLimited(t *testing.T) {
+	var mu sync.Mutex
+	var txns []string
+	defer fakeHomeserver(t, func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "/_matrix/client/v3/rooms/!room:example.org/send/m.room.message/"
+		if r.Method != "PUT" || len(r.URL.Path) <= len(prefix) || r.URL.Path[:len(prefix)] != prefix {
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		var content map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+			t.Errorf("bad body: %v", err)
+		}
+		if content["msgtype"] != "m.notice" || content["body"] != "PR 1 is open" || content["formatted_body"] != "PR <b>1</b> is open" {
+			t.Errorf("content = %v", content)
+		}
+
+		mu.Lock()
+		txns = append(txns, r.URL.Path[len(prefix):])
+		n := len(txns)
+		mu.Unlock()
+		switch n {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","error":"slow down","retry_after_ms":10}`))
+		default:
+			w.Write([]byte(`{"event_id":"$1"}`))
+		}
+	})()
+
+	start := time.Now()
+	if !deliverMatrix(context.Background(), matrixOutgoing{"!room:example.org", "PR \x021\x02 is open", "txn1"}) {
+		t.Fatal("deliverMatrix returned false")
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Error("didn't wait out retry_after_ms")
+	}
+	if len(txns) != 2 || txns[0] != "txn1" || txns[1] != "txn1" {
+		t.Errorf("transactions = %v, want txn1 twice", txns)
+	}
+}
+
+func TestMatrixAliasJoinedOnce(t *testing.T) {
+	joins, sends := 0, 0
+	defer fakeHomeserver(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/_matrix/client/v3/join/#room:example.org":
+			joins++
+			w.Write([]byte(`{"room_id":"!room:example.org"}`))
+		case r.Method == "PUT":
+			sends++
+			w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	})()
+
+	for i := 0; i < 3; i++ {
+		deliverMatrix(context.Background(), matrixOutgoing{"#room:example.org", "hello", "txn"})
+	}
+	if joins != 1 || sends != 3 {
+		t.Errorf("%d joins and %d sends, want 1 and 3", joins, sends)
+	}
+	if name := matrixRoomName("!room:example.org"); name != "#room:example.org" {
+		t.Errorf("room name = %q", name)
+	}
+}
+
+const testSync = `{
+	"next_batch": "s2",
+	"rooms": {
+		"join": {
+			"!room:example.org": {"timeline": {"events": [
+				{"type": "m.room.message", "sender": "@alice:example.org", "content": {"msgtype": "m.text", "body": "!subscriptions"}},
+				{"type": "m.room.message", "sender": "@gnatsirc:example.org", "content": {"msgtype": "m.text", "body": "!subscriptions"}},
+				{"type": "m.room.message", "sender": "@bob:example.org", "content": {"msgtype": "m.text", "body": "* !subscriptions", "m.new_content": {}}}
+			]}}
+		},
+		"invite": {
+			"!dm:example.org": {"invite_state": {"events": [
+				{"type": "m.room.member", "sender": "@alice:example.org", "state_key": "@gnatsirc:example.org", "content": {"membership": "invite", "is_direct": true}}
+			]}},
+			"!public:example.org": {"invite_state": {"events": [
+				{"type": "m.room.member", "sender": "@alice:example.org", "state_key": "@gnatsirc:example.org", "content": {"membership": "invite"}}
+			]}}
+		}
+	}
+}`
+
+func TestMatrixSync(t *testing.T) {
+	var joined []string
+	defer fakeHomeserver(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/_matrix/client/v3/sync":
+			if r.URL.Query().Get("since") != "s1" {
+				t.Errorf("since = %q", r.URL.Query().Get("since"))
+			}
+			w.Write([]byte(testSync))
+		case r.Method == "POST" && r.URL.Path == "/_matrix/client/v3/join/!dm:example.org":
+			joined = append(joined, "!dm:example.org")
+			w.Write([]byte(`{"room_id":"!dm:example.org"}`))
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	})()
+	defer func() {
+		stateMu.Lock()
+		state = newBotState()
+		stateMu.Unlock()
+	}()
+
+	var resp matrixSync
+	if err := matrixRequest(context.Background(), "GET", "/sync?since=s1", nil, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.NextBatch != "s2" {
+		t.Errorf("next_batch = %q", resp.NextBatch)
+	}
+
+	acceptMatrixInvites(context.Background(), &resp)
+	if len(joined) != 1 {
+		t.Errorf("joined %v, want only the direct chat", joined)
+	}
+	stateMu.Lock()
+	dm := state.MatrixDMs["@alice:example.org"]
+	stateMu.Unlock()
+	if dm != "!dm:example.org" {
+		t.Errorf("direct chat with alice = %q", dm)
+	}
+
+	for id, room := range resp.Rooms.Join {
+		for _, ev := range room.Timeline.Events {
+			handleMatrixEvent(id, &ev)
+		}
+	}
+	// Only alice's message is answered: not our own, nor an edit.
+	select {
+	case out := <-matrixOut:
+		if out.target != "!room:example.org" || out.text != "You have no subscriptions" {
+			t.Errorf("answer = %+v", out)
+		}
+	default:
+		t.Fatal("no answer")
+	}
+	select {
+	case out := <-matrixOut:
+		t.Errorf("unexpected answer %+v", out)
+	default:
+	}
+}
+
+func TestStripReplyFallback(t *testing.T) {
+	tests := []struct{ body, want string }{
+		{"no reply", "no reply"},
+		{"> <@bob:example.org> PR 1\n\n!status", "!status"},
+		{"> quote\n> more\n\ntext\nmore text", "text\nmore text"},
+		{"> only a quote", ""},
+	}
+	for _, test := range tests {
+		if got := stripReplyFallback(test.body); got != test.want {
+			t.Errorf("stripReplyFallback(%q) = %q, want %q", test.body, got, test.want)
+		}
+	}
+}
+
+func TestMatrixAnnouncedWhileIRCIsDown(t *testing.T) {
+	old := getConfig()
+	setConfig(&Config{Channels: []*ChannelConfig{
+		{Name: "#netbsd-bugs"},
+		{Name: "!room:example.org"},
+	}})
+	defer setConfig(old)
+	oldClient := currentClient()
+	setCurrentClient(nil)
+	defer setCurrentClient(oldClient)
+
+	pr := &PR{Number: 55501, Category: "bin", Synopsis: "ls is slow"}
+	announceNewPR(&prEvent{Kind: eventNew, Number: pr.Number, Category: pr.Category, Synopsis: pr.Synopsis}, pr)
+	flushNewPRs()
+
+	select {
+	case out := <-matrixOut:
+		if out.target != "!room:example.org" || !strings.Contains(out.text, "55501") {
+			t.Errorf("sent %+v", out)
+		}
+	default:
+		t.Fatal("nothing sent to the Matrix room")
+	}
+	select {
+	case out := <-matrixOut:
+		t.Errorf("unexpected %+v", out)
+	default:
+	}
+	if depth := queueDepth(); depth[priorityAnnounce] != 0 {
+		t.Errorf("%d lines queued for IRC", depth[priorityAnnounce])
+	}
+}
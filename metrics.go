@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the GNATS fetch latency histogram buckets, in seconds.
+var fetchBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Lookup outcomes, for PR numbers mentioned in channels.
+const (
+	lookupFound    = "found"
+	lookupNotFound = "not_found"
+	lookupError    = "error"
+)
+
+// metrics are counters and timestamps exported on /metrics, in the
+// Prometheus text format.
+var metrics = struct {
+	sync.Mutex
+	reconnects  int
+	messagesIn  int
+	messagesOut int
+	lookups     map[string]int
+
+	fetchCounts []int
+	fetchCount  int
+	fetchSum    float64
+	fetchErrors int
+	lastFetchOK time.Time
+
+	// linkDown is when we were last disconnected, or started.
+	linkDown time.Time
+	watchers map[string]time.Time
+	// latestPR is the highest PR the scan for new PRs has found.
+	latestPR int
+}{
+	lookups:     make(map[string]int),
+	fetchCounts: make([]int, len(fetchBuckets)),
+	lastFetchOK: startTime,
+	linkDown:    startTime,
+	watchers:    make(map[string]time.Time),
+}
+
+func countReconnect() {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.reconnects++
+	metrics.linkDown = time.Now()
+}
+
+func countMessageIn() {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.messagesIn++
+}
+
+// watchOutgoing is the writer's debug callback, seeing every line sent.
+func watchOutgoing(line string) {
+	watchPings(line)
+	logOutgoing(line)
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.messagesOut++
+}
+
+func countLookup(outcome string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.lookups[outcome]++
+}
+
+// observeFetch records how long a request to GNATS took and whether it
+// failed.
+func observeFetch(d time.Duration, err error) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	secs := d.Seconds()
+	metrics.fetchCount++
+	metrics.fetchSum += secs
+	for i, le := range fetchBuckets {
+		if secs <= le {
+			metrics.fetchCounts[i]++
+		}
+	}
+	if err != nil {
+		metrics.fetchErrors++
+	} else {
+		metrics.lastFetchOK = time.Now()
+	}
+}
+
+// noteLatestPR records that the scan for new PRs found num.
+func noteLatestPR(num int) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	if num > metrics.latestPR {
+		metrics.latestPR = num
+	}
+}
+
+func latestPR() int {
+	metrics.Lock()
+	defer metrics.Unlock()
+	return metrics.latestPR
+}
+
+// watcherSucceeded notes that a background watcher finished a round.
+func watcherSucceeded(name string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.watchers[name] = time.Now()
+}
+
+// serveHTTP serves /metrics and /healthz, the feeds and API, and mail
+// unsubscribe links on addr.
+func serveHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/healthz", handleHealthz)
+	registerFeeds(mux)
+	mux.HandleFunc("/unsubscribe", handleUnsubscribe)
+
+	botLog.Info("Serving HTTP", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		botLog.Fatal("Cannot serve HTTP", "err", err)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+func writeMetrics(w io.Writer) {
+	gauge := func(name, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+	}
+	counter := func(name, help string, value int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+
+	connected := 0.0
+	if currentClient() != nil {
+		connected = 1
+	}
+	gauge("gnatsirc_irc_connected", "Whether the bot is connected and registered.", connected)
+	lag, _ := currentLag()
+	gauge("gnatsirc_irc_lag_seconds", "Round trip time of the last keepalive PING.", lag.Seconds())
+	gauge("gnatsirc_latest_pr", "Highest PR number found by the scan for new PRs.", float64(latestPR()))
+
+	fmt.Fprintf(w, "# HELP gnatsirc_send_queue_depth Messages waiting to be sent.\n# TYPE gnatsirc_send_queue_depth gauge\n")
+	for p, n := range queueDepth() {
+		fmt.Fprintf(w, "gnatsirc_send_queue_depth{priority=%q} %d\n", priorityNames[p], n)
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	counter("gnatsirc_irc_reconnects_total", "Connections to IRC lost.", metrics.reconnects)
+	counter("gnatsirc_irc_messages_received_total", "IRC messages received.", metrics.messagesIn)
+	counter("gnatsirc_irc_messages_sent_total", "IRC messages sent.", metrics.messagesOut)
+
+	fmt.Fprintf(w, "# HELP gnatsirc_lookups_total PR numbers looked up for channels, by outcome.\n# TYPE gnatsirc_lookups_total counter\n")
+	for _, outcome := range []string{lookupFound, lookupNotFound, lookupError} {
+		fmt.Fprintf(w, "gnatsirc_lookups_total{outcome=%q} %d\n", outcome, metrics.lookups[outcome])
+	}
+
+	fmt.Fprintf(w, "# HELP gnatsirc_gnats_fetch_seconds Time taken to fetch a PR from GNATS.\n# TYPE gnatsirc_gnats_fetch_seconds histogram\n")
+	for i, le := range fetchBuckets {
+		fmt.Fprintf(w, "gnatsirc_gnats_fetch_seconds_bucket{le=\"%g\"} %d\n", le, metrics.fetchCounts[i])
+	}
+	fmt.Fprintf(w, "gnatsirc_gnats_fetch_seconds_bucket{le=\"+Inf\"} %d\n", metrics.fetchCount)
+	fmt.Fprintf(w, "gnatsirc_gnats_fetch_seconds_sum %g\n", metrics.fetchSum)
+	fmt.Fprintf(w, "gnatsirc_gnats_fetch_seconds_count %d\n", metrics.fetchCount)
+	counter("gnatsirc_gnats_fetch_errors_total", "Failed requests to GNATS.", metrics.fetchErrors)
+
+	var names []string
+	for name := range metrics.watchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "# HELP gnatsirc_watcher_last_success_timestamp_seconds When a watcher last finished a round.\n# TYPE gnatsirc_watcher_last_success_timestamp_seconds gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "gnatsirc_watcher_last_success_timestamp_seconds{watcher=%q} %d\n", name, metrics.watchers[name].Unix())
+	}
+}
+
+// handleHealthz fails when we have been off IRC, or unable to reach GNATS,
+// for longer than -health-timeout.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	var problems []string
+
+	metrics.Lock()
+	linkDown, lastFetchOK := metrics.linkDown, metrics.lastFetchOK
+	metrics.Unlock()
+
+	if currentClient() == nil && time.Since(linkDown) > *healthTimeout {
+		problems = append(problems, fmt.Sprintf("not connected to IRC since %v", linkDown.Format(time.RFC3339)))
+	}
+	if time.Since(lastFetchOK) > *healthTimeout {
+		problems = append(problems, fmt.Sprintf("no successful GNATS fetch since %v", lastFetchOK.Format(time.RFC3339)))
+	}
+
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, p := range problems {
+			fmt.Fprintln(w, p)
+		}
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
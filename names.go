@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"gopkg.in/irc.v3"
+)
+
+// Who is in the channels we are in, kept up to date from NAMES replies
+// and JOIN/PART/KICK/QUIT/NICK messages.
+var (
+	namesMu sync.Mutex
+	names   = make(map[string]map[string]bool)
+	// Channels whose NAMES reply is still arriving.
+	namesPending = make(map[string]bool)
+)
+
+func nickKey(nick string) string {
+	return strings.ToLower(nick)
+}
+
+// trackNames updates channel membership from m.
+func trackNames(c *irc.Client, m *irc.Message) {
+	namesMu.Lock()
+	defer namesMu.Unlock()
+
+	switch m.Command {
+	case irc.RPL_NAMREPLY:
+		// <me> <type> <channel> :<nicks>
+		if len(m.Params) < 4 {
+			return
+		}
+		ch := nickKey(m.Params[2])
+		if !namesPending[ch] {
+			names[ch] = make(map[string]bool)
+			namesPending[ch] = true
+		}
+		for _, nick := range strings.Fields(m.Trailing()) {
+			names[ch][nickKey(strings.TrimLeft(nick, "~&@%+"))] = true
+		}
+	case irc.RPL_ENDOFNAMES:
+		if len(m.Params) >= 2 {
+			delete(namesPending, nickKey(m.Params[1]))
+		}
+	case "JOIN":
+		if len(m.Params) < 1 {
+			return
+		}
+		ch := nickKey(m.Params[0])
+		if names[ch] == nil {
+			names[ch] = make(map[string]bool)
+		}
+		names[ch][nickKey(m.Prefix.Name)] = true
+	case "PART":
+		if len(m.Params) < 1 {
+			return
+		}
+		partChannel(c, m.Params[0], m.Prefix.Name)
+	case "KICK":
+		if len(m.Params) < 2 {
+			return
+		}
+		partChannel(c, m.Params[0], m.Params[1])
+	case "QUIT":
+		for _, members := range names {
+			delete(members, nickKey(m.Prefix.Name))
+		}
+	case "NICK":
+		if len(m.Params) < 1 {
+			return
+		}
+		for _, members := range names {
+			if members[nickKey(m.Prefix.Name)] {
+				delete(members, nickKey(m.Prefix.Name))
+				members[nickKey(m.Params[0])] = true
+			}
+		}
+	}
+}
+
+// partChannel removes nick from ch, or forgets ch if we left it.
+// The caller must hold namesMu.
+func partChannel(c *irc.Client, ch, nick string) {
+	if nickKey(nick) == nickKey(ownNick()) {
+		delete(names, nickKey(ch))
+		return
+	}
+	if members := names[nickKey(ch)]; members != nil {
+		delete(members, nickKey(nick))
+	}
+}
+
+// inChannel reports whether nick is in ch according to our NAMES list.
+func inChannel(ch, nick string) bool {
+	namesMu.Lock()
+	defer namesMu.Unlock()
+	return names[nickKey(ch)][nickKey(nick)]
+}
+
+// resetNames forgets all membership, for when we are disconnected.
+func resetNames() {
+	namesMu.Lock()
+	defer namesMu.Unlock()
+	names = make(map[string]map[string]bool)
+	namesPending = make(map[string]bool)
+}
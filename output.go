@@ -0,0 +1,331 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"gopkg.in/irc.v3"
+)
+
+const (
+	// RFC 1459 line limit, including the trailing CRLF.
+	maxLineLength = 512
+	// Worst case for parts of our own prefix we haven't seen yet.
+	maxUserLength = 10
+	maxHostLength = 63
+	// A message longer than this many lines is cut short with an ellipsis.
+	maxSplitLines = 3
+	ellipsis      = "…"
+)
+
+// Our user and host as others see them, learned from our own JOINs. The
+// server adds ":nick!user@host " to everything we send before relaying
+// it, which counts against the line limit. selfNick is the client's
+// current nick, which only its reader may ask it for.
+var (
+	selfMu   sync.Mutex
+	selfNick string
+	selfUser string
+	selfHost string
+)
+
+// ownNick is our current nick.
+func ownNick() string {
+	selfMu.Lock()
+	defer selfMu.Unlock()
+	return selfNick
+}
+
+// trackSelf learns our nick, user and host.
+func trackSelf(c *irc.Client, m *irc.Message) {
+	selfMu.Lock()
+	defer selfMu.Unlock()
+
+	selfNick = c.CurrentNick()
+	switch m.Command {
+	case "JOIN":
+		if nickKey(m.Prefix.Name) == nickKey(selfNick) && m.Prefix.Host != "" {
+			selfUser, selfHost = m.Prefix.User, m.Prefix.Host
+		}
+	case "396":
+		// RPL_HOSTHIDDEN <nick> <host> :is now your displayed host
+		if len(m.Params) >= 2 {
+			selfHost = m.Params[1]
+		}
+	}
+}
+
+// lineBudget is how many bytes of text fit in one command to target.
+func lineBudget(c *irc.Client, command, target string) int {
+	selfMu.Lock()
+	userLen, hostLen := len(selfUser), len(selfHost)
+	selfMu.Unlock()
+	if hostLen == 0 {
+		userLen, hostLen = maxUserLength, maxHostLength
+	}
+
+	// ":nick!user@host COMMAND target :text\r\n"
+	prefix := 1 + len(ownNick()) + 1 + userLen + 1 + hostLen + 1
+	return maxLineLength - 2 - prefix - len(command) - 1 - len(target) - 2
+}
+
+// sanitize makes s safe to put in a message: line breaks and NUL would end
+// or corrupt the line, other control characters except the IRC formatting
+// codes are dropped, and invalid UTF-8 is replaced.
+func sanitize(s string) string {
+	s = strings.ToValidUTF8(s, "�")
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\r', '\n', '\t', 0:
+			return ' '
+		case '\x02', '\x03', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+			// Bold, colour, reset, monospace, reverse, italic,
+			// strikethrough and underline.
+			return r
+		}
+		if r < ' ' || r == '\x7f' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// splitText splits s into at most maxLines lines of at most max bytes, on
+// rune boundaries and preferably between words. If that's not enough, the
+// last line is ellipsized. Formatting carries over onto the next line.
+func splitText(s string, max, maxLines int) []string {
+	// Lines can always take a rune, so every line makes progress.
+	if max < utf8.UTFMax {
+		max = utf8.UTFMax
+	}
+	var lines []string
+	var f ircFormat
+	for len(s) > max {
+		if len(lines) == maxLines-1 {
+			return append(lines, ellipsize(s, max))
+		}
+		cut := safeCut(s, max)
+		if i := strings.LastIndexByte(s[:cut], ' '); i > cut*3/4 {
+			cut = i
+		}
+		if cut == 0 {
+			// A colour code too long for the line.
+			cut = colourEnd(s, 0)
+		}
+		lines = append(lines, strings.TrimRight(s[:cut], " "))
+		f.scan(s[:cut])
+		s = strings.TrimLeft(s[cut:], " ")
+		if p := f.codes(); p != "" && len(p)+utf8.UTFMax <= max {
+			// The codes set the state again when the line is scanned.
+			s = p + s
+			f = ircFormat{}
+		}
+	}
+	return append(lines, s)
+}
+
+// ellipsize cuts s to at most max bytes on a rune boundary, marking the
+// cut with an ellipsis.
+func ellipsize(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	cut := max - len(ellipsis)
+	if cut < 0 {
+		cut = 0
+	}
+	return s[:safeCut(s, cut)] + ellipsis
+}
+
+// safeCut moves a cut of s at byte cut back to a rune boundary that isn't
+// in the middle of a colour code.
+func safeCut(s string, cut int) int {
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	// "\x0304,01" is the longest colour code.
+	for i := cut - 1; i >= 0 && i >= cut-5; i-- {
+		if s[i] == '\x03' {
+			if colourEnd(s, i) > cut {
+				cut = i
+			}
+			break
+		}
+	}
+	return cut
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// colourEnd returns where the colour code at s[i] ends: "\x03", then
+// optionally one or two digits of foreground, then optionally a comma and
+// one or two digits of background.
+func colourEnd(s string, i int) int {
+	i++
+	digits := func() int {
+		n := 0
+		for n < 2 && i < len(s) && isDigit(s[i]) {
+			i++
+			n++
+		}
+		return n
+	}
+	if digits() > 0 && i+1 < len(s) && s[i] == ',' && isDigit(s[i+1]) {
+		i++
+		digits()
+	}
+	return i
+}
+
+// ircFormat is the IRC formatting in effect at some point of a line.
+type ircFormat struct {
+	bold, italic, underline, reverse, strike, mono bool
+	fg, bg                                         string
+}
+
+// scan applies the formatting codes in s.
+func (f *ircFormat) scan(s string) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\x02':
+			f.bold = !f.bold
+		case '\x1d':
+			f.italic = !f.italic
+		case '\x1f':
+			f.underline = !f.underline
+		case '\x16':
+			f.reverse = !f.reverse
+		case '\x1e':
+			f.strike = !f.strike
+		case '\x11':
+			f.mono = !f.mono
+		case '\x0f':
+			*f = ircFormat{}
+		case '\x03':
+			end := colourEnd(s, i)
+			code := strings.SplitN(s[i+1:end], ",", 2)
+			f.fg = code[0]
+			if f.fg == "" {
+				f.bg = ""
+			} else if len(code) == 2 {
+				f.bg = code[1]
+			}
+			i = end - 1
+		}
+	}
+}
+
+// codes are the formatting codes that set f at the start of a line.
+func (f *ircFormat) codes() string {
+	var b strings.Builder
+	if f.fg != "" {
+		// Two digits, so digits in the text can't extend them.
+		b.WriteString("\x03" + twoDigits(f.fg))
+		if f.bg != "" {
+			b.WriteString("," + twoDigits(f.bg))
+		}
+	}
+	for _, c := range []struct {
+		on   bool
+		code string
+	}{
+		{f.bold, "\x02"}, {f.italic, "\x1d"}, {f.underline, "\x1f"},
+		{f.reverse, "\x16"}, {f.strike, "\x1e"}, {f.mono, "\x11"},
+	} {
+		if c.on {
+			b.WriteString(c.code)
+		}
+	}
+	return b.String()
+}
+
+func twoDigits(n string) string {
+	if len(n) == 1 {
+		return "0" + n
+	}
+	return n
+}
+
+// writeMessage is how everything is sent. Parameters are sanitised, and
+// the text of a PRIVMSG or NOTICE is split to fit the line limit. CTCP
+// messages are never split, only shortened. The result is queued to be
+// sent with the given priority. PRIVMSGs and NOTICEs to Matrix rooms and
+// users go to the Matrix sink instead, whole.
+func writeMessage(c *irc.Client, priority int, m *irc.Message) {
+	if len(m.Params) == 0 {
+		enqueue(c, priority, m)
+		return
+	}
+	if (m.Command == "PRIVMSG" || m.Command == "NOTICE") && isMatrixTarget(m.Params[0]) {
+		sendMatrix(m.Params[0], m.Trailing())
+		return
+	}
+
+	m = m.Copy()
+	last := len(m.Params) - 1
+	for i := 0; i < last; i++ {
+		// Middle parameters can't contain spaces either.
+		m.Params[i] = strings.Replace(sanitize(m.Params[i]), " ", "", -1)
+	}
+	if m.Command != "PRIVMSG" && m.Command != "NOTICE" {
+		m.Params[last] = sanitize(m.Params[last])
+		enqueue(c, priority, m)
+		return
+	}
+
+	budget := lineBudget(c, m.Command, m.Params[0])
+	text := m.Params[last]
+	if isCTCPText(text) {
+		inner := sanitize(strings.Trim(text, ctcpDelimiter))
+		m.Params[last] = ctcpDelimiter + ellipsize(inner, budget-2) + ctcpDelimiter
+		deliver(c, priority, m)
+		return
+	}
+
+	for _, line := range splitText(sanitize(text), budget, maxSplitLines) {
+		lm := m.Copy()
+		lm.Params[last] = line
+		deliver(c, priority, lm)
+	}
+}
+
+// divert, when set, gets the PRIVMSGs and NOTICEs that would be sent, for
+// -dry-run and the console. Those to services still go out.
+var divert func(m *irc.Message)
+
+// services are who the bot talks to to identify and get its nick back.
+var services = []string{"NickServ"}
+
+func isService(target string) bool {
+	for _, s := range services {
+		if strings.EqualFold(s, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func deliver(c *irc.Client, priority int, m *irc.Message) {
+	if divert != nil && !isService(m.Params[0]) {
+		divert(m)
+		return
+	}
+	enqueue(c, priority, m)
+}
+
+// say sends text to target.
+func say(c *irc.Client, priority int, target, text string) {
+	if isMuted(target) {
+		return
+	}
+	writeMessage(c, priority, &irc.Message{
+		Command: "PRIVMSG",
+		Params: []string{
+			target,
+			text,
+		},
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"plain text", "plain text"},
+		{"two\r\nlines", "two  lines"},
+		{"tab\tand\x00nul", "tab and nul"},
+		{"bell\x07 and del\x7f", "bell and del"},
+		{"\x02bold\x02 \x0304red\x03 \x1ditalic\x1d \x1funder\x1f \x16rev\x16 \x1estrike\x1e \x11mono\x11\x0f",
+			"\x02bold\x02 \x0304red\x03 \x1ditalic\x1d \x1funder\x1f \x16rev\x16 \x1estrike\x1e \x11mono\x11\x0f"},
+		{"bad \xff utf-8", "bad � utf-8"},
+		{"über", "über"},
+	}
+	for _, test := range tests {
+		if got := sanitize(test.in); got != test.want {
+			t.Errorf("sanitize(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestEllipsize(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"a bit too long", 10, "a bit t" + ellipsis},
+		{"ääääää", 8, "ää" + ellipsis},
+		{"ääääää", 9, "äää" + ellipsis},
+		{"colour \x0304,01red", 15, "colour " + ellipsis},
+		{"anything", 0, ellipsis},
+		{"anything", -3, ellipsis},
+	}
+	for _, test := range tests {
+		if got := ellipsize(test.in, test.max); got != test.want {
+			t.Errorf("ellipsize(%q, %d) = %q, want %q", test.in, test.max, got, test.want)
+		}
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		in       string
+		max      int
+		maxLines int
+		want     []string
+	}{
+		{"fits", 10, 3, []string{"fits"}},
+		{"one two three four", 14, 3, []string{"one two three", "four"}},
+		{"one two three four", 10, 3, []string{"one two th", "ree four"}},
+		{"abcdefghijklmnop", 10, 3, []string{"abcdefghij", "klmnop"}},
+		{"ääääääää", 5, 9, []string{"ää", "ää", "ää", "ää"}},
+		{"one two three four five six seven", 14, 2, []string{"one two three", "four five s" + ellipsis}},
+		// Budgets too small for anything still make progress.
+		{"äbc", 0, 9, []string{"äbc"}},
+		{"äbcdéfgh", -10, 9, []string{"äbc", "déf", "gh"}},
+		// Formatting carries over.
+		{"\x02bold text here\x02 plain", 12, 3, []string{"\x02bold text", "\x02here\x02 plain"}},
+		{"\x0304,1red text here", 12, 3, []string{"\x0304,1red tex", "\x0304,01t here"}},
+		{"\x0304red\x0f plain and more", 12, 3, []string{"\x0304red\x0f plai", "n and more"}},
+		// Colour codes aren't cut.
+		{"abcdefgh\x0304red", 10, 3, []string{"abcdefgh", "\x0304red"}},
+	}
+	for _, test := range tests {
+		got := splitText(test.in, test.max, test.maxLines)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitText(%q, %d, %d) = %q, want %q", test.in, test.max, test.maxLines, got, test.want)
+		}
+		for _, line := range got {
+			if !utf8.ValidString(line) {
+				t.Errorf("splitText(%q, %d, %d): invalid UTF-8 in %q", test.in, test.max, test.maxLines, line)
+			}
+		}
+	}
+
+	long := strings.Repeat("word ", 1000)
+	for _, line := range splitText(long, 100, 1000) {
+		if len(line) > 100 {
+			t.Errorf("line of %d bytes", len(line))
+		}
+	}
+}
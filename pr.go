@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// errNoSuchPR is returned for PRs that don't exist or aren't public.
+var errNoSuchPR = errors.New("no such PR")
+
+// PR is the part of a GNATS problem report the bot works with.
+type PR struct {
+	Number      int    `json:"number"`
+	Synopsis    string `json:"synopsis"`
+	Category    string `json:"category"`
+	State       string `json:"state"`
+	Severity    string `json:"severity"`
+	Responsible string `json:"responsible"`
+
+	// LastModified is zero if the PR was never modified or the date
+	// could not be parsed.
+	LastModified time.Time `json:"last_modified"`
+
+	// Description is only used to match rules against, and is too big
+	// to be worth remembering.
+	Description string `json:"-"`
+}
+
+// Layouts seen in GNATS date fields.
+var gnatsDateLayouts = []string{
+	time.RFC1123Z,
+	time.RubyDate,
+	time.UnixDate,
+	"Mon Jan _2 15:04:05 -0700 2006",
+}
+
+func parseGnatsDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range gnatsDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// fetchPR downloads and parses a PR. Confidential and non-existent PRs
+// have no synopsis and are reported as errors.
+func fetchPR(prNum int) (*PR, error) {
+	prText, err := getPRText(toGnatsUrl(prNum))
+	if err != nil {
+		return nil, err
+	}
+	synopsis, err := findPRSynopsis(prText)
+	if err != nil {
+		// Non-existent and confidential PRs both come without one.
+		return nil, errNoSuchPR
+	}
+	category, err := findPRCategory(prText)
+	if err != nil {
+		return nil, err
+	}
+
+	// These are informational, an old PR missing one is still a PR.
+	state, _ := findPRState(prText)
+	severity, _ := findFirstSubmatch(prText, severityRegexp)
+	responsible, _ := findFirstSubmatch(prText, responsibleRegexp)
+	lastModified, _ := findFirstSubmatch(prText, lastModifiedRegexp)
+	description, _ := findFirstSubmatch(prText, descriptionRegexp)
+
+	return &PR{
+		Number:      prNum,
+		Synopsis:    strings.TrimSpace(synopsis),
+		Category:    strings.TrimSpace(category),
+		State:       strings.TrimSpace(state),
+		Severity:    strings.TrimSpace(severity),
+		Responsible: strings.TrimSpace(responsible),
+
+		LastModified: parseGnatsDate(lastModified),
+		Description:  strings.TrimSpace(description),
+	}, nil
+}
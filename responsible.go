@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"gopkg.in/irc.v3"
+)
+
+// RPL_WHOISACCOUNT isn't in RFC 2812, but the common ircds all send it.
+const rplWhoisAccount = "330"
+
+// developer maps a GNATS Responsible login to someone on IRC.
+type developer struct {
+	Login   string `json:"login"`
+	Nick    string `json:"nick"`
+	Account string `json:"account"`
+	// Mentions is set when they asked to be highlighted.
+	Mentions bool `json:"mentions"`
+}
+
+// Callbacks waiting for the account of a nick, by nickKey.
+var (
+	whoisMu      sync.Mutex
+	whoisPending = make(map[string][]func(account string))
+)
+
+// whoisAccount asks the server which NickServ account nick is logged in
+// as and calls done with it, or with "" if they aren't identified.
+func whoisAccount(c *irc.Client, nick string, done func(account string)) {
+	whoisMu.Lock()
+	key := nickKey(nick)
+	first := len(whoisPending[key]) == 0
+	whoisPending[key] = append(whoisPending[key], done)
+	whoisMu.Unlock()
+
+	if first {
+		writeMessage(c, priorityProtocol, &irc.Message{
+			Command: "WHOIS",
+			Params:  []string{nick},
+		})
+	}
+}
+
+// whoisSender is whoisAccount for whoever sent m. Messages from Matrix
+// carry the sender's user ID as account tag instead.
+func whoisSender(c *irc.Client, m *irc.Message, done func(account string)) {
+	if isMatrixTarget(m.Prefix.Name) {
+		account, _ := m.Tags.GetTag("account")
+		done(account)
+		return
+	}
+	whoisAccount(c, m.Prefix.Name, done)
+}
+
+func finishWhois(nick, account string) {
+	whoisMu.Lock()
+	key := nickKey(nick)
+	callbacks := whoisPending[key]
+	delete(whoisPending, key)
+	whoisMu.Unlock()
+
+	for _, done := range callbacks {
+		done(account)
+	}
+}
+
+func resetWhois() {
+	whoisMu.Lock()
+	defer whoisMu.Unlock()
+	whoisPending = make(map[string][]func(account string))
+}
+
+// trackDevelopers completes WHOIS lookups and follows nick changes of
+// registered developers.
+func trackDevelopers(m *irc.Message) {
+	switch m.Command {
+	case rplWhoisAccount:
+		// <me> <nick> <account> :is logged in as
+		if len(m.Params) >= 3 {
+			finishWhois(m.Params[1], m.Params[2])
+		}
+	case irc.RPL_ENDOFWHOIS:
+		if len(m.Params) >= 2 {
+			finishWhois(m.Params[1], "")
+		}
+	case "NICK":
+		if len(m.Params) < 1 {
+			return
+		}
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		for _, dev := range state.Developers {
+			if nickKey(dev.Nick) == nickKey(m.Prefix.Name) {
+				dev.Nick = m.Params[0]
+				saveStateLocked()
+			}
+		}
+	}
+}
+
+// configNick returns the nick the config file maps login to.
+func configNick(login string) (string, bool) {
+	for l, nick := range getConfig().Nicks {
+		if strings.EqualFold(l, login) {
+			return nick, true
+		}
+	}
+	return "", false
+}
+
+// configAccount returns the account the config file maps login to.
+func configAccount(login string) (string, bool) {
+	for l, account := range getConfig().Accounts {
+		if strings.EqualFold(l, login) {
+			return account, true
+		}
+	}
+	return "", false
+}
+
+// mayClaim reports whether whoever is logged in to account may register
+// as login: the account the config file maps login to, or else the
+// account named like login.
+func mayClaim(login, account string) bool {
+	if mapped, ok := configAccount(login); ok {
+		return strings.EqualFold(mapped, account)
+	}
+	return strings.EqualFold(login, account)
+}
+
+// registeredLocked returns who registered as login with !iam, unless the
+// config file says it's someone else. The caller must hold stateMu.
+func registeredLocked(login string) (*developer, bool) {
+	dev, ok := state.Developers[strings.ToLower(login)]
+	if !ok || !mayClaim(dev.Login, dev.Account) {
+		return nil, false
+	}
+	return dev, true
+}
+
+// nickForLogin returns the IRC nick of a GNATS login, if known. A
+// registered developer's current nick is used, as long as they are who
+// the config file says; otherwise the config file's nick.
+func nickForLogin(login string) (string, bool) {
+	stateMu.Lock()
+	dev, ok := registeredLocked(login)
+	var nick string
+	if ok {
+		nick = dev.Nick
+	}
+	stateMu.Unlock()
+	if ok {
+		return nick, true
+	}
+
+	return configNick(login)
+}
+
+// mention returns a "nick: " highlight for the responsible of a PR
+// announced in ch, if they opted in and are there to see it.
+func mention(ch, login string) string {
+	stateMu.Lock()
+	dev, ok := registeredLocked(login)
+	var nick string
+	if ok && dev.Mentions {
+		nick = dev.Nick
+	}
+	stateMu.Unlock()
+	if nick == "" || !inChannel(ch, nick) {
+		return ""
+	}
+	return nick + ": "
+}
+
+// developerByNick finds who nick, logged in to account, is: from !iam
+// or the config file.
+func developerByNick(nick, account string) *developer {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	for _, dev := range state.Developers {
+		if dev.Account == account && mayClaim(dev.Login, account) {
+			return dev
+		}
+	}
+	for login, n := range getConfig().Nicks {
+		if nickKey(n) == nickKey(nick) && mayClaim(login, account) {
+			login = strings.ToLower(login)
+			dev := &developer{Login: login, Nick: nick, Account: account}
+			state.Developers[login] = dev
+			return dev
+		}
+	}
+	return nil
+}
+
+// !iam [login]
+func cmdIam(c *irc.Client, m *irc.Message, args []string) {
+	nick := m.Prefix.Name
+	if len(args) == 0 {
+		for _, dev := range developers() {
+			if nickKey(dev.Nick) == nickKey(nick) {
+				reply(c, m, fmt.Sprintf("You are %s, mentions %s", dev.Login, onOff(dev.Mentions)))
+				return
+			}
+		}
+		reply(c, m, "I don't know who you are, tell me with !iam <login>")
+		return
+	}
+
+	login := strings.ToLower(args[0])
+	whoisSender(c, m, func(account string) {
+		if account == "" {
+			reply(c, m, "Please identify with NickServ first")
+			return
+		}
+		if !mayClaim(login, account) {
+			reply(c, m, fmt.Sprintf("Your account %s isn't %s's, ask an admin to map it in the config file", account, login))
+			return
+		}
+
+		stateMu.Lock()
+		dev, ok := state.Developers[login]
+		if ok && dev.Account != "" && dev.Account != account {
+			stateMu.Unlock()
+			reply(c, m, fmt.Sprintf("%s is already registered to another account", login))
+			return
+		}
+		state.Developers[login] = &developer{
+			Login:    login,
+			Nick:     nick,
+			Account:  account,
+			Mentions: true,
+		}
+		saveStateLocked()
+		stateMu.Unlock()
+		reply(c, m, fmt.Sprintf("Hi %s, I will highlight you on your PRs. Use !mentions off to stop.", login))
+	})
+}
+
+// !mentions on|off
+func cmdMentions(c *irc.Client, m *irc.Message, args []string) {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		reply(c, m, "Usage: !mentions on|off")
+		return
+	}
+
+	nick := m.Prefix.Name
+	whoisSender(c, m, func(account string) {
+		if account == "" {
+			reply(c, m, "Please identify with NickServ first")
+			return
+		}
+		dev := developerByNick(nick, account)
+		if dev == nil {
+			reply(c, m, "I don't know who you are, tell me with !iam <login>")
+			return
+		}
+
+		stateMu.Lock()
+		dev.Nick = nick
+		dev.Account = account
+		dev.Mentions = args[0] == "on"
+		saveStateLocked()
+		stateMu.Unlock()
+		reply(c, m, fmt.Sprintf("Mentions for %s are now %s", dev.Login, onOff(dev.Mentions)))
+	})
+}
+
+func developers() []developer {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	devs := make([]developer, 0, len(state.Developers))
+	for _, dev := range state.Developers {
+		devs = append(devs, *dev)
+	}
+	return devs
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestMayClaim(t *testing.T) {
+	old := getConfig()
+	setConfig(&Config{
+		Nicks: map[string]string{
+			"riastradh": "riastradh_",
+			"christos":  "christos",
+		},
+		Accounts: map[string]string{
+			"riastradh": "taylor",
+			"Christos":  "christos",
+		},
+	})
+	defer setConfig(old)
+
+	tests := []struct {
+		login, account string
+		want           bool
+	}{
+		// The account isn't the nick.
+		{"riastradh", "taylor", true},
+		{"riastradh", "Taylor", true},
+		{"riastradh", "riastradh_", false},
+		{"riastradh", "riastradh", false},
+		{"christos", "christos", true},
+		{"christos", "mallory", false},
+		// Not in the config, so only the account of the same name.
+		{"martin", "martin", true},
+		{"martin", "mallory", false},
+	}
+	for _, test := range tests {
+		if got := mayClaim(test.login, test.account); got != test.want {
+			t.Errorf("mayClaim(%q, %q) = %v, want %v", test.login, test.account, got, test.want)
+		}
+	}
+
+	stateMu.Lock()
+	oldState := state
+	state = newBotState()
+	stateMu.Unlock()
+	defer func() {
+		stateMu.Lock()
+		state = oldState
+		stateMu.Unlock()
+	}()
+	if dev := developerByNick("riastradh_", "riastradh_"); dev != nil {
+		t.Errorf("account named like the nick is %s", dev.Login)
+	}
+	if dev := developerByNick("riastradh_", "taylor"); dev == nil || dev.Login != "riastradh" {
+		t.Errorf("riastradh_ logged in as taylor is %+v", dev)
+	}
+}
+
+func TestWhoisAccount(t *testing.T) {
+	defer resetWhois()
+	defer clearSendQueue()
+
+	var accounts []string
+	done := func(account string) { accounts = append(accounts, account) }
+	whoisAccount(offlineClient, "Alice", done)
+	whoisAccount(offlineClient, "alice", done)
+
+	sendQueue.Lock()
+	var sent []string
+	for _, q := range sendQueue.queues[priorityProtocol] {
+		sent = append(sent, q.m.String())
+	}
+	sendQueue.Unlock()
+	if len(sent) != 1 || sent[0] != "WHOIS Alice" {
+		t.Errorf("queued %q, want one WHOIS", sent)
+	}
+
+	finishWhois("ALICE", "alice")
+	if len(accounts) != 2 || accounts[0] != "alice" || accounts[1] != "alice" {
+		t.Errorf("accounts = %q", accounts)
+	}
+}
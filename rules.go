@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	ruleAlert   = "alert"
+	ruleInclude = "include"
+	ruleExclude = "exclude"
+
+	defaultAlertMarker = "[!]"
+)
+
+// Rule is a watch rule evaluated against every new PR.
+//
+// An "alert" rule prefixes matching announcements with Marker and mirrors
+// them to AlertChannel if set; a rule limited to Channels only mirrors PRs
+// announced in one of them. If a channel has "include" rules, only PRs
+// matching one of them are announced there. PRs matching an "exclude" rule
+// are never announced, nor mirrored, in the channels it applies to.
+type Rule struct {
+	Name string `json:"name"`
+	// Match is a case insensitive regexp.
+	Match string `json:"match"`
+	// Fields to match against: synopsis, description, category,
+	// severity, responsible. Synopsis and description if empty.
+	Fields []string `json:"fields"`
+	// Action is alert (the default), include or exclude.
+	Action string `json:"action"`
+	// Channels the rule applies to, all channels if empty.
+	Channels     []string `json:"channels"`
+	AlertChannel string   `json:"alert_channel"`
+	Marker       string   `json:"marker"`
+
+	re *regexp.Regexp
+}
+
+func (r *Rule) parse() error {
+	switch r.Action {
+	case "":
+		r.Action = ruleAlert
+	case ruleAlert, ruleInclude, ruleExclude:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+
+	if len(r.Fields) == 0 {
+		r.Fields = []string{"synopsis", "description"}
+	}
+	for _, f := range r.Fields {
+		if _, ok := prField(&PR{}, f); !ok {
+			return fmt.Errorf("unknown field %q", f)
+		}
+	}
+
+	if r.Marker == "" {
+		r.Marker = defaultAlertMarker
+	}
+
+	re, err := regexp.Compile("(?i)" + r.Match)
+	if err != nil {
+		return err
+	}
+	r.re = re
+	return nil
+}
+
+func prField(pr *PR, field string) (string, bool) {
+	switch field {
+	case "synopsis":
+		return pr.Synopsis, true
+	case "description":
+		return pr.Description, true
+	case "category":
+		return pr.Category, true
+	case "severity":
+		return pr.Severity, true
+	case "responsible":
+		return pr.Responsible, true
+	}
+	return "", false
+}
+
+func (r *Rule) appliesTo(ch string) bool {
+	if len(r.Channels) == 0 {
+		return true
+	}
+	for _, name := range r.Channels {
+		if strings.EqualFold(name, ch) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matches(pr *PR) bool {
+	for _, f := range r.Fields {
+		if v, _ := prField(pr, f); r.re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether an exclude rule keeps pr out of ch.
+func excluded(rules []*Rule, ch string, pr *PR) bool {
+	for _, r := range rules {
+		if r.Action == ruleExclude && r.appliesTo(ch) && r.matches(pr) {
+			return true
+		}
+	}
+	return false
+}
+
+// routePR decides whether a new PR is announced in ch, and with which
+// highlight marker.
+func routePR(ch *ChannelConfig, pr *PR) (marker string, ok bool) {
+	if !allowedCategory(ch, pr.Category) {
+		return "", false
+	}
+	rules := getConfig().Rules
+	if excluded(rules, ch.Name, pr) {
+		return "", false
+	}
+
+	hasInclude, included := false, false
+	for _, r := range rules {
+		if !r.appliesTo(ch.Name) {
+			continue
+		}
+		switch r.Action {
+		case ruleInclude:
+			hasInclude = true
+			if r.matches(pr) {
+				included = true
+			}
+		case ruleAlert:
+			if marker == "" && r.matches(pr) {
+				marker = r.Marker
+			}
+		}
+	}
+	if hasInclude && !included {
+		return "", false
+	}
+	return marker, true
+}
+
+// alert is an alert channel a PR is mirrored to, with the marker of the
+// rule that sent it there.
+type alert struct {
+	channel, marker string
+}
+
+// alertChannels returns the alert channels pr is mirrored to, sorted.
+// announced holds the lowercased channels pr is announced in anyway,
+// which it isn't mirrored to again.
+func alertChannels(pr *PR, announced map[string]bool) []alert {
+	rules := getConfig().Rules
+	seen := make(map[string]bool)
+	var alerts []alert
+	for _, r := range rules {
+		if r.Action != ruleAlert || r.AlertChannel == "" {
+			continue
+		}
+		key := strings.ToLower(r.AlertChannel)
+		if seen[key] || announced[key] || !r.matches(pr) || !r.announcedIn(announced) || excluded(rules, r.AlertChannel, pr) {
+			continue
+		}
+		seen[key] = true
+		alerts = append(alerts, alert{r.AlertChannel, r.Marker})
+	}
+	sort.Slice(alerts, func(i, j int) bool { return strings.ToLower(alerts[i].channel) < strings.ToLower(alerts[j].channel) })
+	return alerts
+}
+
+// announcedIn reports whether one of the channels the rule is limited to,
+// if any, is in announced.
+func (r *Rule) announcedIn(announced map[string]bool) bool {
+	if len(r.Channels) == 0 {
+		return true
+	}
+	for _, name := range r.Channels {
+		if announced[strings.ToLower(name)] {
+			return true
+		}
+	}
+	return false
+}
+
+// withMarker prefixes text with a rule marker, if there is one.
+func withMarker(marker, text string) string {
+	if marker == "" {
+		return text
+	}
+	return marker + " " + text
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// withRules sets the config's rules until the returned function is
+// called.
+func withRules(t *testing.T, rules ...*Rule) func() {
+	for _, r := range rules {
+		if err := r.parse(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := getConfig()
+	setConfig(&Config{Rules: rules})
+	return func() { setConfig(old) }
+}
+
+func TestRoutePR(t *testing.T) {
+	defer withRules(t,
+		&Rule{Match: "panic"},
+		&Rule{Match: "security", Marker: "[sec]"},
+		&Rule{Match: "^(kern|lib)$", Fields: []string{"category"}, Action: ruleInclude, Channels: []string{"#NetBSD-kern"}},
+		&Rule{Match: "spam", Action: ruleExclude},
+		&Rule{Match: "wontfix", Action: ruleExclude, Channels: []string{"#netbsd-bugs"}},
+	)()
+
+	bugs := &ChannelConfig{Name: "#netbsd-bugs"}
+	kern := &ChannelConfig{Name: "#netbsd-kern"}
+	ports := &ChannelConfig{Name: "#netbsd-ports", Categories: []string{"port-amd64"}}
+	tests := []struct {
+		ch       *ChannelConfig
+		pr       PR
+		marker   string
+		announce bool
+	}{
+		{bugs, PR{Synopsis: "ls is slow", Category: "bin"}, "", true},
+		{bugs, PR{Synopsis: "PANIC in uvm", Category: "kern"}, "[!]", true},
+		{bugs, PR{Synopsis: "panic on security check", Category: "kern"}, "[!]", true},
+		{bugs, PR{Synopsis: "buffer overflow", Description: "a security hole", Category: "lib"}, "[sec]", true},
+		{bugs, PR{Synopsis: "buy spam", Category: "bin"}, "", false},
+		{bugs, PR{Synopsis: "wontfix panic", Category: "bin"}, "", false},
+		{kern, PR{Synopsis: "wontfix panic", Category: "kern"}, "[!]", true},
+		{kern, PR{Synopsis: "ls is slow", Category: "bin"}, "", false},
+		{kern, PR{Synopsis: "malloc is slow", Category: "lib"}, "", true},
+		{kern, PR{Synopsis: "spam in kern", Category: "kern"}, "", false},
+		{ports, PR{Synopsis: "panic on boot", Category: "port-amd64"}, "[!]", true},
+		{ports, PR{Synopsis: "panic on boot", Category: "port-i386"}, "", false},
+	}
+	for _, test := range tests {
+		marker, ok := routePR(test.ch, &test.pr)
+		if marker != test.marker || ok != test.announce {
+			t.Errorf("routePR(%s, %q in %s) = %q, %v, want %q, %v", test.ch.Name, test.pr.Synopsis, test.pr.Category,
+				marker, ok, test.marker, test.announce)
+		}
+	}
+}
+
+func TestAlertChannels(t *testing.T) {
+	defer withRules(t,
+		&Rule{Match: "security", AlertChannel: "#security", Marker: "[sec]"},
+		&Rule{Match: "panic", AlertChannel: "#Alerts"},
+		&Rule{Match: "panic", AlertChannel: "#alerts", Marker: "[second]"},
+		&Rule{Match: "panic", AlertChannel: "#kern-alerts", Channels: []string{"#netbsd-kern"}},
+		&Rule{Match: "regression", AlertChannel: "#netbsd-bugs"},
+		&Rule{Match: "xen", Fields: []string{"category"}, Action: ruleExclude, Channels: []string{"#security"}},
+		&Rule{Match: "spam", Action: ruleExclude},
+	)()
+
+	tests := []struct {
+		pr        PR
+		announced []string
+		want      []alert
+	}{
+		{PR{Synopsis: "ls is slow"}, nil, nil},
+		// Sorted, one per channel, the first matching rule's marker.
+		{PR{Synopsis: "security panic"}, []string{"#netbsd-bugs"},
+			[]alert{{"#Alerts", "[!]"}, {"#security", "[sec]"}}},
+		// Only mirrored by scoped rules if announced in their channels.
+		{PR{Synopsis: "panic"}, []string{"#netbsd-kern"},
+			[]alert{{"#Alerts", "[!]"}, {"#kern-alerts", "[!]"}}},
+		// Not mirrored where it is announced anyway.
+		{PR{Synopsis: "regression"}, []string{"#netbsd-bugs"}, nil},
+		{PR{Synopsis: "regression"}, nil, []alert{{"#netbsd-bugs", "[!]"}}},
+		// Excludes apply to alert channels too.
+		{PR{Synopsis: "security panic", Category: "port-xen"}, nil, []alert{{"#Alerts", "[!]"}}},
+		{PR{Synopsis: "security spam"}, nil, nil},
+	}
+	for _, test := range tests {
+		announced := make(map[string]bool)
+		for _, name := range test.announced {
+			announced[name] = true
+		}
+		if got := alertChannels(&test.pr, announced); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("alertChannels(%q, %v) = %v, want %v", test.pr.Synopsis, test.announced, got, test.want)
+		}
+	}
+}
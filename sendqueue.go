@@ -0,0 +1,209 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+// Priorities of queued messages, most urgent first. PONGs are sent by the
+// client itself and never wait in the queue at all.
+const (
+	priorityProtocol = iota
+	priorityReply
+	priorityAnnounce
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"protocol", "reply", "announce"}
+
+// Defaults for FloodConfig, well within what common ircds tolerate.
+const (
+	defaultSendInterval   = 2 * time.Second
+	defaultSendBurst      = 5
+	defaultTargetInterval = time.Second
+	defaultTargetBurst    = 3
+	// Idle per-target buckets are forgotten after this long.
+	targetBucketIdle = time.Minute
+)
+
+// tokenBucket allows burst messages at once, then one per interval.
+type tokenBucket struct {
+	interval time.Duration
+	burst    int
+	tokens   float64
+	last     time.Time
+	// used is when a token was last taken.
+	used time.Time
+}
+
+func newTokenBucket(interval time.Duration, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{interval: interval, burst: burst, tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += float64(now.Sub(b.last)) / float64(b.interval)
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+}
+
+// wait is how long until a token is available, 0 if there is one now.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(b.interval))
+}
+
+func (b *tokenBucket) take() {
+	b.tokens--
+	b.used = b.last
+}
+
+type queuedMessage struct {
+	client *irc.Client
+	m      *irc.Message
+}
+
+// sendQueue holds outgoing messages until the flood limits allow them.
+var sendQueue = struct {
+	sync.Mutex
+	cond    *sync.Cond
+	queues  [numPriorities][]queuedMessage
+	network *tokenBucket
+	targets map[string]*tokenBucket
+}{
+	targets: make(map[string]*tokenBucket),
+}
+
+func init() {
+	sendQueue.cond = sync.NewCond(&sendQueue.Mutex)
+}
+
+// enqueue queues m to be sent on c.
+func enqueue(c *irc.Client, priority int, m *irc.Message) {
+	sendQueue.Lock()
+	defer sendQueue.Unlock()
+	sendQueue.queues[priority] = append(sendQueue.queues[priority], queuedMessage{c, m})
+	sendQueue.cond.Broadcast()
+}
+
+// queueDepth returns how many messages wait at each priority.
+func queueDepth() [numPriorities]int {
+	sendQueue.Lock()
+	defer sendQueue.Unlock()
+
+	var depth [numPriorities]int
+	for p, q := range sendQueue.queues {
+		depth[p] = len(q)
+	}
+	return depth
+}
+
+func queueEmptyLocked() bool {
+	for _, q := range sendQueue.queues {
+		if len(q) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// drainSendQueue waits until everything queued has been sent, or until
+// deadline, and returns how many messages are still waiting.
+func drainSendQueue(deadline time.Time) int {
+	for {
+		left := 0
+		for _, n := range queueDepth() {
+			left += n
+		}
+		if left == 0 || time.Now().After(deadline) {
+			return left
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// clearSendQueue drops everything queued for a connection that is gone.
+func clearSendQueue() {
+	sendQueue.Lock()
+	defer sendQueue.Unlock()
+	for p := range sendQueue.queues {
+		sendQueue.queues[p] = nil
+	}
+	sendQueue.cond.Broadcast()
+}
+
+// pickLocked removes the next message allowed out: the most urgent one
+// whose target isn't over its limit. If none may be sent yet, it returns
+// how long to wait.
+func pickLocked(now time.Time) (*queuedMessage, time.Duration) {
+	flood := getConfig().floodLimits()
+	if sendQueue.network == nil {
+		sendQueue.network = newTokenBucket(flood.interval, flood.Burst, now)
+	}
+	sendQueue.network.interval, sendQueue.network.burst = flood.interval, flood.Burst
+	if wait := sendQueue.network.wait(now); wait > 0 {
+		return nil, wait
+	}
+
+	for target, b := range sendQueue.targets {
+		idle := now.Sub(b.used)
+		if idle > targetBucketIdle && idle > time.Duration(b.burst)*b.interval {
+			delete(sendQueue.targets, target)
+		}
+	}
+
+	minWait := time.Duration(-1)
+	for p, q := range sendQueue.queues {
+		for i, qm := range q {
+			target := ""
+			if len(qm.m.Params) > 0 {
+				target = nickKey(qm.m.Params[0])
+			}
+			b := sendQueue.targets[target]
+			if b == nil {
+				b = newTokenBucket(flood.targetInterval, flood.TargetBurst, now)
+				sendQueue.targets[target] = b
+			}
+			b.interval, b.burst = flood.targetInterval, flood.TargetBurst
+
+			wait := b.wait(now)
+			if wait == 0 {
+				sendQueue.queues[p] = append(q[:i:i], q[i+1:]...)
+				b.take()
+				sendQueue.network.take()
+				return &qm, 0
+			}
+			if minWait < 0 || wait < minWait {
+				minWait = wait
+			}
+		}
+	}
+	return nil, minWait
+}
+
+// runSendQueue writes queued messages as fast as the limits allow.
+func runSendQueue() {
+	for {
+		sendQueue.Lock()
+		for queueEmptyLocked() {
+			sendQueue.cond.Wait()
+		}
+		qm, wait := pickLocked(time.Now())
+		sendQueue.Unlock()
+
+		if qm == nil {
+			time.Sleep(wait)
+			continue
+		}
+		// Lines queued for a previous connection are stale.
+		if qm.client == currentClient() {
+			qm.client.WriteMessage(qm.m)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2020, 3, 4, 12, 0, 0, 0, time.UTC)
+	b := newTokenBucket(2*time.Second, 3, start)
+
+	// steps take a token at each offset from start, if one is there.
+	steps := []struct {
+		at   time.Duration
+		wait time.Duration
+	}{
+		// The burst goes out at once.
+		{0, 0},
+		{0, 0},
+		{0, 0},
+		// Then one per interval.
+		{0, 2 * time.Second},
+		{500 * time.Millisecond, 1500 * time.Millisecond},
+		{2 * time.Second, 0},
+		{2 * time.Second, 2 * time.Second},
+		// Idling refills up to the burst, not beyond.
+		{time.Minute, 0},
+		{time.Minute, 0},
+		{time.Minute, 0},
+		{time.Minute, 2 * time.Second},
+	}
+	for i, step := range steps {
+		now := start.Add(step.at)
+		wait := b.wait(now)
+		if wait != step.wait {
+			t.Errorf("step %d at %v: wait = %v, want %v", i, step.at, wait, step.wait)
+		}
+		if wait == 0 {
+			b.take()
+			if !b.used.Equal(now) {
+				t.Errorf("step %d: used = %v, want %v", i, b.used, now)
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+const (
+	// How long queued messages get to go out before we QUIT anyway.
+	drainTimeout = 10 * time.Second
+	// How long the server gets to close the connection after our QUIT.
+	quitTimeout = 5 * time.Second
+	// How long watchers get to finish what they are doing.
+	watcherTimeout = 10 * time.Second
+)
+
+// stopping is closed when the bot is shutting down; watchers waiting in
+// sleep return early, and the reconnect loop stops.
+var (
+	stopping = make(chan struct{})
+	stopOnce sync.Once
+	watchers sync.WaitGroup
+)
+
+// sleep waits for d, and returns false if we started shutting down
+// meanwhile.
+func sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stopping:
+		return false
+	}
+}
+
+// stoppingContext returns a context cancelled when shutdown begins, for
+// requests that would otherwise hold it up.
+func stoppingContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopping
+		cancel()
+	}()
+	return ctx
+}
+
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// watch runs f, a loop that returns once we are stopping, in the
+// background.
+func watch(f func()) {
+	watchers.Add(1)
+	go func() {
+		defer watchers.Done()
+		f()
+	}()
+}
+
+// handleSignals shuts down cleanly on SIGINT or SIGTERM. A second signal
+// exits right away.
+func handleSignals() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-sigs
+	botLog.Info("Shutting down", "signal", sig)
+	go shutdown()
+
+	sig = <-sigs
+	botLog.Warn("Signalled again, exiting now", "signal", sig)
+	flushState()
+	os.Exit(1)
+}
+
+// shutdown stops the watchers and reconnecting, lets what's queued go
+// out, and QUITs. connectForever then returns to main, which finishes
+// up with finishShutdown.
+func shutdown() {
+	stopOnce.Do(func() { close(stopping) })
+
+	c := currentClient()
+	if c == nil {
+		disconnect("shutting down")
+		return
+	}
+
+	if left := drainSendQueue(time.Now().Add(drainTimeout)); left > 0 {
+		botLog.Warn("Dropping queued messages", "count", left)
+	}
+	c.WriteMessage(&irc.Message{
+		Command: "QUIT",
+		Params:  []string{*quitMessage},
+	})
+
+	time.AfterFunc(quitTimeout, func() {
+		disconnect("server didn't close the connection after QUIT")
+	})
+}
+
+// finishShutdown waits for the watchers and saves the state.
+func finishShutdown() {
+	done := make(chan struct{})
+	go func() {
+		watchers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(watcherTimeout):
+		botLog.Warn("Watchers didn't stop in time", "timeout", watcherTimeout)
+	}
+
+	flushState()
+	botLog.Info("Shut down")
+}
+
+func flushState() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	saveStateLocked()
+}
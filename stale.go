@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Pause between two reminders so a batch does not arrive as a wall of text.
+const staleReminderPause = 5 * time.Second
+
+// staleRecord is a PR found to be stale, and when we last nagged about it.
+type staleRecord struct {
+	PR
+	LastReminded time.Time `json:"last_reminded"`
+}
+
+// runStaleReminders periodically looks for PRs waiting in one of the
+// configured states for too long and reminds people about a few of them.
+func runStaleReminders() {
+	for {
+		cfg := getConfig().Stale
+		if cfg == nil {
+			if !sleep(time.Hour) {
+				return
+			}
+			continue
+		}
+
+		sweepStale(cfg)
+		sendStaleReminders(cfg)
+		watcherSucceeded("stale")
+		if !sleep(cfg.interval) {
+			return
+		}
+	}
+}
+
+func isStale(cfg *StaleConfig, pr *PR, now time.Time) bool {
+	if pr.LastModified.IsZero() {
+		return false
+	}
+	if now.Sub(pr.LastModified) < time.Duration(cfg.Days)*24*time.Hour {
+		return false
+	}
+	for _, s := range cfg.States {
+		if pr.State == s {
+			return true
+		}
+	}
+	return false
+}
+
+// noteStale adds pr to or removes it from the stale set.
+func noteStale(cfg *StaleConfig, pr *PR) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	rec, ok := state.Stale[pr.Number]
+	if !isStale(cfg, pr, time.Now()) {
+		if ok {
+			delete(state.Stale, pr.Number)
+			saveStateLocked()
+		}
+		return
+	}
+	if !ok {
+		rec = &staleRecord{}
+		state.Stale[pr.Number] = rec
+	}
+	changed := !ok || !samePR(&rec.PR, pr)
+	rec.PR = *pr
+	if changed {
+		saveStateLocked()
+	}
+}
+
+// staleScanRange is the range of PRs the stale scan goes through: from
+// cfg.ScanFrom, or the lowest PR we track if unset, to the highest.
+func staleScanRange(cfg *StaleConfig) (from, to int) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	lowest, highest := PRStartScan, PRStartScan
+	for num := range state.PRs {
+		if num < lowest {
+			lowest = num
+		}
+		if num > highest {
+			highest = num
+		}
+	}
+	if cfg.ScanFrom > 0 {
+		return cfg.ScanFrom, highest
+	}
+	return lowest, highest
+}
+
+// sweepStale checks the PRs we already track, and fetches the next
+// cfg.Scan PRs of the range being scanned.
+func sweepStale(cfg *StaleConfig) {
+	for _, pr := range openTrackedPRs() {
+		noteStale(cfg, &pr)
+	}
+
+	stateMu.Lock()
+	cursor := state.StaleCursor
+	stateMu.Unlock()
+
+	from, to := staleScanRange(cfg)
+	for i := 0; i < cfg.Scan; i++ {
+		if cursor < from || cursor > to {
+			cursor = from
+		}
+		pr, err := fetchPR(cursor)
+		if err == nil {
+			noteStale(cfg, pr)
+		}
+		cursor++
+	}
+
+	stateMu.Lock()
+	if state.StaleCursor != cursor {
+		state.StaleCursor = cursor
+		saveStateLocked()
+	}
+	stateMu.Unlock()
+}
+
+// dueStale returns up to cfg.Batch stale PRs not reminded about recently,
+// the longest untouched first.
+func dueStale(cfg *StaleConfig) []PR {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	cutoff := time.Now().Add(-time.Duration(cfg.RemindEvery) * 24 * time.Hour)
+	var prs []PR
+	for _, rec := range state.Stale {
+		if rec.LastReminded.Before(cutoff) {
+			prs = append(prs, rec.PR)
+		}
+	}
+	sort.Slice(prs, func(i, j int) bool {
+		return prs[i].LastModified.Before(prs[j].LastModified)
+	})
+	if len(prs) > cfg.Batch {
+		prs = prs[:cfg.Batch]
+	}
+	return prs
+}
+
+func sendStaleReminders(cfg *StaleConfig) {
+	for i, old := range dueStale(cfg) {
+		// It may have been touched since we found it.
+		pr, err := fetchPR(old.Number)
+		if err != nil {
+			gnatsLog.Warn("Re-checking stale PR failed", "pr", old.Number, "err", err)
+			continue
+		}
+		noteStale(cfg, pr)
+		if !isStale(cfg, pr, time.Now()) {
+			continue
+		}
+
+		if i > 0 && !sleep(staleReminderPause) {
+			return
+		}
+		if !remindStale(cfg, pr) {
+			continue
+		}
+
+		stateMu.Lock()
+		if rec, ok := state.Stale[pr.Number]; ok {
+			rec.LastReminded = time.Now()
+		}
+		saveStateLocked()
+		stateMu.Unlock()
+	}
+}
+
+// remindStale sends one reminder and reports whether it went anywhere.
+// Targets not reachable right now don't count.
+func remindStale(cfg *StaleConfig, pr *PR) bool {
+	days := int(time.Since(pr.LastModified).Hours() / 24)
+
+	if nick, ok := nickForLogin(pr.Responsible); ok && cfg.DMResponsible {
+		c := clientFor(nick)
+		if c == nil {
+			return false
+		}
+		say(c, priorityAnnounce, nick, fmt.Sprintf("Reminder: your PR %d has been in %s for %d days: %s %s",
+			pr.Number, pr.State, days, toGnatsUrl(pr.Number), pr.Synopsis))
+		return true
+	}
+
+	sent := false
+	outText := fmt.Sprintf("[stale: %s for %d days] %s (%s) %s",
+		pr.State, days, toGnatsUrl(pr.Number), pr.Category, pr.Synopsis)
+	for _, ch := range channels() {
+		if !ch.StaleReminders || !allowedCategory(ch, pr.Category) {
+			continue
+		}
+		c := clientFor(ch.Name)
+		if c == nil {
+			continue
+		}
+		say(c, priorityAnnounce, ch.Name, outText)
+		sent = true
+	}
+	return sent
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestStaleScanRange(t *testing.T) {
+	stateMu.Lock()
+	old := state
+	state = newBotState()
+	stateMu.Unlock()
+	defer func() {
+		stateMu.Lock()
+		state = old
+		stateMu.Unlock()
+	}()
+
+	check := func(cfg *StaleConfig, wantFrom, wantTo int) {
+		t.Helper()
+		if from, to := staleScanRange(cfg); from != wantFrom || to != wantTo {
+			t.Errorf("ScanFrom %d: scanning %d-%d, want %d-%d", cfg.ScanFrom, from, to, wantFrom, wantTo)
+		}
+	}
+
+	// Nothing tracked yet, so where the scan for new PRs starts.
+	check(&StaleConfig{}, PRStartScan, PRStartScan)
+
+	stateMu.Lock()
+	for _, num := range []int{58100, 59500, 59300} {
+		state.PRs[num] = &trackedPR{PR: PR{Number: num}}
+	}
+	stateMu.Unlock()
+	check(&StaleConfig{}, 58100, 59500)
+	check(&StaleConfig{ScanFrom: 50000}, 50000, 59500)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// botState is everything the bot remembers across restarts. It is kept
+// in memory and written out as JSON to -state-file whenever it changes.
+type botState struct {
+	PRs        map[int]*trackedPR   `json:"prs"`
+	Events     []prEvent            `json:"events"`
+	LastDigest map[string]time.Time `json:"last_digest"`
+
+	Stale       map[int]*staleRecord `json:"stale"`
+	StaleCursor int                  `json:"stale_cursor"`
+
+	// Developers registered with !iam, by GNATS login.
+	Developers map[string]*developer `json:"developers"`
+
+	// Subscribers by NickServ account.
+	Subscribers map[string]*subscriber `json:"subscribers"`
+
+	// Webhooks are the webhook deliveries not made yet.
+	Webhooks []*webhookDelivery `json:"webhooks"`
+
+	// Mail is the mails not sent yet, and Unsubscribed the addresses
+	// that used an unsubscribe link, lowercased.
+	Mail         []*queuedMail        `json:"mail"`
+	Unsubscribed map[string]time.Time `json:"unsubscribed"`
+
+	// MatrixDMs are the direct chat rooms with Matrix users, by user ID.
+	MatrixDMs map[string]string `json:"matrix_dms"`
+}
+
+var (
+	stateMu   sync.Mutex
+	state     = newBotState()
+	stateFile string
+)
+
+func newBotState() *botState {
+	return &botState{
+		PRs:         make(map[int]*trackedPR),
+		LastDigest:  make(map[string]time.Time),
+		Stale:       make(map[int]*staleRecord),
+		Developers:  make(map[string]*developer),
+		Subscribers: make(map[string]*subscriber),
+		MatrixDMs:   make(map[string]string),
+
+		Unsubscribed: make(map[string]time.Time),
+	}
+}
+
+func loadState(path string) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	stateFile = path
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s := newBotState()
+	if err := json.Unmarshal(data, s); err != nil {
+		return err
+	}
+	// Files written by older versions lack the newer maps.
+	if s.PRs == nil {
+		s.PRs = make(map[int]*trackedPR)
+	}
+	if s.LastDigest == nil {
+		s.LastDigest = make(map[string]time.Time)
+	}
+	if s.Stale == nil {
+		s.Stale = make(map[int]*staleRecord)
+	}
+	if s.Developers == nil {
+		s.Developers = make(map[string]*developer)
+	}
+	if s.Subscribers == nil {
+		s.Subscribers = make(map[string]*subscriber)
+	}
+	if s.Unsubscribed == nil {
+		s.Unsubscribed = make(map[string]time.Time)
+	}
+	if s.MatrixDMs == nil {
+		s.MatrixDMs = make(map[string]string)
+	}
+	state = s
+	return nil
+}
+
+// saveStateLocked writes the state file. The caller must hold stateMu.
+func saveStateLocked() {
+	if stateFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		botLog.Error("Cannot encode state", "err", err)
+		return
+	}
+
+	// Write to a temporary file first so a crash never leaves a
+	// truncated state file behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(stateFile), ".gnatsirc-state")
+	if err != nil {
+		botLog.Error("Cannot save state", "err", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), stateFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		botLog.Error("Cannot save state", "err", err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/irc.v3"
+)
+
+const maxSubscriptions = 20
+
+// subscription is one filter of a subscriber. Kind is "category",
+// "severity" or "synopsis", the latter matching Value as a regexp.
+type subscription struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+
+	re *regexp.Regexp
+}
+
+// subscriber is someone who gets matching PR events by DM.
+type subscriber struct {
+	Account string          `json:"account"`
+	Nick    string          `json:"nick"`
+	Subs    []*subscription `json:"subscriptions"`
+}
+
+func (s *subscription) String() string {
+	return s.Kind + " " + s.Value
+}
+
+// matches reports whether ev is wanted. The caller must hold stateMu.
+func (s *subscription) matches(ev *prEvent) bool {
+	switch s.Kind {
+	case "category":
+		return strings.EqualFold(ev.Category, s.Value)
+	case "severity":
+		return strings.EqualFold(ev.Severity, s.Value)
+	case "synopsis":
+		if s.re == nil {
+			re, err := regexp.Compile("(?i)" + s.Value)
+			if err != nil {
+				return false
+			}
+			s.re = re
+		}
+		return s.re.MatchString(ev.Synopsis)
+	}
+	return false
+}
+
+// notifySubscribers sends ev by DM to everyone with a matching filter.
+func notifySubscribers(ev *prEvent) {
+	var nicks []string
+	stateMu.Lock()
+	for _, sub := range state.Subscribers {
+		for _, s := range sub.Subs {
+			if s.matches(ev) {
+				nicks = append(nicks, sub.Nick)
+				break
+			}
+		}
+	}
+	stateMu.Unlock()
+
+	for _, nick := range nicks {
+		c := clientFor(nick)
+		if c == nil {
+			continue
+		}
+		say(c, priorityAnnounce, nick, formatEvent("", ev, nil))
+	}
+}
+
+// trackSubscribers follows nick changes so DMs reach the right person.
+func trackSubscribers(m *irc.Message) {
+	if m.Command != "NICK" || len(m.Params) < 1 {
+		return
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	for _, sub := range state.Subscribers {
+		if nickKey(sub.Nick) == nickKey(m.Prefix.Name) {
+			sub.Nick = m.Params[0]
+			saveStateLocked()
+		}
+	}
+}
+
+// withAccount runs f with the NickServ account of whoever sent m, or
+// tells them to identify first.
+func withAccount(c *irc.Client, m *irc.Message, f func(account string)) {
+	whoisSender(c, m, func(account string) {
+		if account == "" {
+			reply(c, m, "Please identify with NickServ first")
+			return
+		}
+		f(account)
+	})
+}
+
+// !subscribe category|severity|synopsis <value>
+func cmdSubscribe(c *irc.Client, m *irc.Message, args []string) {
+	if len(args) < 2 {
+		reply(c, m, "Usage: !subscribe category <name> | severity <level> | synopsis <regexp>")
+		return
+	}
+	s := &subscription{
+		Kind:  strings.ToLower(args[0]),
+		Value: strings.Join(args[1:], " "),
+	}
+	switch s.Kind {
+	case "category", "severity":
+	case "synopsis":
+		if _, err := regexp.Compile(s.Value); err != nil {
+			reply(c, m, fmt.Sprintf("Bad regexp: %v", err))
+			return
+		}
+	default:
+		reply(c, m, "You can subscribe to a category, severity or synopsis")
+		return
+	}
+
+	nick := m.Prefix.Name
+	withAccount(c, m, func(account string) {
+		stateMu.Lock()
+		sub, ok := state.Subscribers[account]
+		if !ok {
+			sub = &subscriber{Account: account}
+			state.Subscribers[account] = sub
+		}
+		sub.Nick = nick
+		n := len(sub.Subs)
+		if n < maxSubscriptions {
+			sub.Subs = append(sub.Subs, s)
+			saveStateLocked()
+		}
+		stateMu.Unlock()
+
+		if n >= maxSubscriptions {
+			reply(c, m, fmt.Sprintf("You already have %d subscriptions", n))
+			return
+		}
+		reply(c, m, fmt.Sprintf("Subscribed to %s, I will DM you new PRs and state changes", s))
+	})
+}
+
+// !unsubscribe <number>|all
+func cmdUnsubscribe(c *irc.Client, m *irc.Message, args []string) {
+	if len(args) != 1 {
+		reply(c, m, "Usage: !unsubscribe <number from !subscriptions>|all")
+		return
+	}
+
+	withAccount(c, m, func(account string) {
+		stateMu.Lock()
+		sub, ok := state.Subscribers[account]
+		if !ok {
+			stateMu.Unlock()
+			reply(c, m, "You have no subscriptions")
+			return
+		}
+
+		if args[0] == "all" {
+			delete(state.Subscribers, account)
+			saveStateLocked()
+			stateMu.Unlock()
+			reply(c, m, "Unsubscribed from everything")
+			return
+		}
+
+		i, err := strconv.Atoi(args[0])
+		if err != nil || i < 1 || i > len(sub.Subs) {
+			stateMu.Unlock()
+			reply(c, m, "No such subscription, see !subscriptions")
+			return
+		}
+		removed := sub.Subs[i-1]
+		sub.Subs = append(sub.Subs[:i-1], sub.Subs[i:]...)
+		if len(sub.Subs) == 0 {
+			delete(state.Subscribers, account)
+		}
+		saveStateLocked()
+		stateMu.Unlock()
+		reply(c, m, fmt.Sprintf("Unsubscribed from %s", removed))
+	})
+}
+
+// !subscriptions
+func cmdSubscriptions(c *irc.Client, m *irc.Message, args []string) {
+	withAccount(c, m, func(account string) {
+		var lines []string
+		stateMu.Lock()
+		if sub, ok := state.Subscribers[account]; ok {
+			for i, s := range sub.Subs {
+				lines = append(lines, fmt.Sprintf("%d. %s", i+1, s))
+			}
+		}
+		stateMu.Unlock()
+
+		if len(lines) == 0 {
+			reply(c, m, "You have no subscriptions")
+			return
+		}
+		privateLines(c, m.Prefix.Name, lines)
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often tracked PRs are re-fetched to notice state changes.
+	stateCheckInterval = 30 * time.Minute
+	// Events are kept long enough to build a weekly digest.
+	eventRetention = 8 * 24 * time.Hour
+	// Upper bound on PRs re-fetched every stateCheckInterval.
+	maxTrackedPRs = 500
+)
+
+const (
+	eventNew   = "new"
+	eventState = "state"
+)
+
+// More new PRs than this for one target in one round aren't announced
+// there, only logged: it's a rescan or GNATS hiccup, not news.
+const maxNewPRLines = 5
+
+// newPRLines are the announcements of new PRs waiting for the end of the
+// round of the scan that found them, by target.
+var newPRLines = struct {
+	sync.Mutex
+	targets []string
+	lines   map[string][]string
+}{lines: make(map[string][]string)}
+
+// trackedPR is a PR the bot has seen, either announced or looked up.
+type trackedPR struct {
+	PR
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// prEvent is something that happened to a PR, used for digests.
+type prEvent struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Number   int       `json:"number"`
+	Category string    `json:"category"`
+	Synopsis string    `json:"synopsis"`
+	// Responsible is the login of who the PR is assigned to.
+	Responsible string `json:"responsible,omitempty"`
+	Severity    string `json:"severity,omitempty"`
+	OldState    string `json:"old_state,omitempty"`
+	NewState    string `json:"new_state,omitempty"`
+}
+
+// trackPR remembers pr and records what changed since it was last seen.
+// isNew marks a PR that was just filed. The recorded event, if any, is
+// returned so the caller can announce it.
+func trackPR(pr *PR, isNew bool) *prEvent {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	now := time.Now()
+	var ev *prEvent
+
+	t, ok := state.PRs[pr.Number]
+	changed := !ok || !samePR(&t.PR, pr)
+	if !ok {
+		t = &trackedPR{FirstSeen: now}
+		state.PRs[pr.Number] = t
+		if isNew {
+			ev = &prEvent{Kind: eventNew, NewState: pr.State}
+		}
+	} else if t.State != "" && pr.State != "" && t.State != pr.State {
+		ev = &prEvent{Kind: eventState, OldState: t.State, NewState: pr.State}
+	}
+	t.PR = *pr
+	// Not worth a write on its own, it only has to be roughly right
+	// for pruning.
+	t.LastSeen = now
+
+	if ev != nil {
+		ev.Time = now
+		ev.Number = pr.Number
+		ev.Category = pr.Category
+		ev.Synopsis = pr.Synopsis
+		ev.Responsible = pr.Responsible
+		ev.Severity = pr.Severity
+		state.Events = append(state.Events, *ev)
+	}
+	if changed {
+		saveStateLocked()
+	}
+
+	return ev
+}
+
+// samePR reports whether a and b have the same remembered fields.
+func samePR(a, b *PR) bool {
+	return a.Number == b.Number &&
+		a.Synopsis == b.Synopsis &&
+		a.Category == b.Category &&
+		a.State == b.State &&
+		a.Severity == b.Severity &&
+		a.Responsible == b.Responsible &&
+		a.LastModified.Equal(b.LastModified)
+}
+
+// eventsSince returns recorded events in [from, to).
+func eventsSince(from, to time.Time) []prEvent {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	var evs []prEvent
+	for _, ev := range state.Events {
+		if !ev.Time.Before(from) && ev.Time.Before(to) {
+			evs = append(evs, ev)
+		}
+	}
+	return evs
+}
+
+// openTrackedPRs returns tracked PRs that are not closed, lowest number first.
+func openTrackedPRs() []PR {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	var prs []PR
+	for _, t := range state.PRs {
+		if t.State != "closed" {
+			prs = append(prs, t.PR)
+		}
+	}
+	sort.Slice(prs, func(i, j int) bool { return prs[i].Number < prs[j].Number })
+	return prs
+}
+
+// pruneTracked forgets old events and closed PRs nobody will ask about,
+// and caps the number of PRs re-fetched on every check.
+func pruneTracked() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	before := len(state.Events) + len(state.PRs)
+
+	cutoff := time.Now().Add(-eventRetention)
+	events := state.Events[:0]
+	for _, ev := range state.Events {
+		if ev.Time.After(cutoff) {
+			events = append(events, ev)
+		}
+	}
+	state.Events = events
+
+	for num, t := range state.PRs {
+		if t.State == "closed" && t.LastSeen.Before(cutoff) {
+			delete(state.PRs, num)
+		}
+	}
+
+	if len(state.PRs) > maxTrackedPRs {
+		nums := make([]int, 0, len(state.PRs))
+		for num := range state.PRs {
+			nums = append(nums, num)
+		}
+		sort.Slice(nums, func(i, j int) bool {
+			return state.PRs[nums[i]].FirstSeen.Before(state.PRs[nums[j]].FirstSeen)
+		})
+		for _, num := range nums[:len(nums)-maxTrackedPRs] {
+			delete(state.PRs, num)
+		}
+	}
+
+	if len(state.Events)+len(state.PRs) != before {
+		saveStateLocked()
+	}
+}
+
+// observeStateChanges periodically re-fetches tracked open PRs so that
+// closed and otherwise changed PRs show up in digests and, where enabled,
+// in channel.
+func observeStateChanges() {
+	for sleep(stateCheckInterval) {
+		pruneTracked()
+
+		for _, old := range openTrackedPRs() {
+			pr, err := fetchPR(old.Number)
+			if err != nil {
+				gnatsLog.Warn("Re-checking PR failed", "pr", old.Number, "err", err)
+				continue
+			}
+			if ev := trackPR(pr, false); ev != nil {
+				publish(ev, pr)
+			}
+		}
+		watcherSucceeded("state_changes")
+	}
+}
+
+// announceNewPR is the event sink announcing new PRs in the channels
+// they are routed to and their alert channels. The lines go out when
+// flushNewPRs ends the round.
+func announceNewPR(ev *prEvent, pr *PR) {
+	newPRLines.Lock()
+	defer newPRLines.Unlock()
+	add := func(target, line string) {
+		if newPRLines.lines[target] == nil {
+			newPRLines.targets = append(newPRLines.targets, target)
+		}
+		newPRLines.lines[target] = append(newPRLines.lines[target], line)
+	}
+
+	announced := make(map[string]bool)
+	for _, ch := range channels() {
+		marker, ok := routePR(ch, pr)
+		if !ok {
+			announceLog.Debug("PR not allowed in channel", "pr", pr.Number, "category", pr.Category, "channel", ch.Name)
+			continue
+		}
+		announced[strings.ToLower(ch.Name)] = true
+		add(ch.Name, withMarker(marker, mention(ch.Name, pr.Responsible)+formatPR(ch.Name, formatNew, pr)))
+	}
+	for _, a := range alertChannels(pr, announced) {
+		add(a.channel, withMarker(a.marker, formatPR(a.channel, formatNew, pr)))
+	}
+}
+
+// flushNewPRs says the new PR announcements of the round, except where
+// there are too many.
+func flushNewPRs() {
+	newPRLines.Lock()
+	targets, lines := newPRLines.targets, newPRLines.lines
+	newPRLines.targets, newPRLines.lines = nil, make(map[string][]string)
+	newPRLines.Unlock()
+
+	for _, target := range targets {
+		if len(lines[target]) > maxNewPRLines {
+			announceLog.Warn("Too many new PRs, skipping", "target", target, "lines", len(lines[target]))
+			for _, line := range lines[target] {
+				announceLog.Info("Would have printed", "target", target, "line", line)
+			}
+			continue
+		}
+		c := clientFor(target)
+		if c == nil {
+			announceLog.Warn("Not connected, not announcing", "target", target, "lines", len(lines[target]))
+			continue
+		}
+		for _, line := range lines[target] {
+			say(c, priorityAnnounce, target, line)
+		}
+	}
+}
+
+func announceStateChange(ev *prEvent, pr *PR) {
+	for _, ch := range channels() {
+		if !ch.StateChanges || !allowedCategory(ch, ev.Category) {
+			continue
+		}
+		c := clientFor(ch.Name)
+		if c == nil {
+			continue
+		}
+		say(c, priorityAnnounce, ch.Name, mention(ch.Name, ev.Responsible)+formatEvent(ch.Name, ev, pr))
+	}
+}
+
+// pr is what ev tells about its PR, for formatting events whose PR isn't
+// at hand anymore.
+func (ev *prEvent) pr() *PR {
+	return &PR{
+		Number:      ev.Number,
+		Synopsis:    ev.Synopsis,
+		Category:    ev.Category,
+		State:       ev.NewState,
+		Severity:    ev.Severity,
+		Responsible: ev.Responsible,
+	}
+}
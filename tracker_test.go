@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/irc.v3"
+)
+
+func TestAnnounceNewPRs(t *testing.T) {
+	rule := &Rule{Match: "panic", AlertChannel: "#alerts"}
+	if err := rule.parse(); err != nil {
+		t.Fatal(err)
+	}
+	old := getConfig()
+	setConfig(&Config{
+		Channels: []*ChannelConfig{
+			{Name: "#netbsd-bugs"},
+			{Name: "#netbsd-kern", Categories: []string{"kern"}},
+		},
+		Rules: []*Rule{rule},
+	})
+	defer setConfig(old)
+	oldClient := currentClient()
+	setCurrentClient(offlineClient)
+	defer setCurrentClient(oldClient)
+
+	said := make(map[string][]string)
+	divert = func(m *irc.Message) {
+		said[m.Params[0]] = append(said[m.Params[0]], m.Trailing())
+	}
+	defer func() { divert = nil }()
+
+	announce := func(pr *PR) {
+		announceNewPR(&prEvent{Kind: eventNew, Number: pr.Number, Category: pr.Category, Synopsis: pr.Synopsis}, pr)
+	}
+	announce(&PR{Number: 55501, Category: "bin", Synopsis: "ls is slow"})
+	announce(&PR{Number: 55502, Category: "kern", Synopsis: "panic in uvm"})
+	if len(said) != 0 {
+		t.Fatalf("announced before the round ended: %v", said)
+	}
+	flushNewPRs()
+
+	targets := make(map[string][]bool)
+	for target, lines := range said {
+		for i := 1; i <= 2; i++ {
+			found := false
+			for _, line := range lines {
+				found = found || strings.Contains(line, fmt.Sprint(55500+i))
+			}
+			targets[target] = append(targets[target], found)
+		}
+	}
+	want := map[string][]bool{
+		"#netbsd-bugs": {true, true},
+		"#netbsd-kern": {false, true},
+		"#alerts":      {false, true},
+	}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("announced %v", said)
+	}
+	if lines := said["#netbsd-kern"]; len(lines) != 1 || !strings.HasPrefix(lines[0], "[!] ") {
+		t.Errorf("alert not marked: %q", lines)
+	}
+
+	// A round with too many is only logged, for that target.
+	said = make(map[string][]string)
+	for i := 10; i < 10+maxNewPRLines; i++ {
+		announce(&PR{Number: i, Category: "bin", Synopsis: "ls is slow"})
+	}
+	announce(&PR{Number: 20, Category: "kern", Synopsis: "uvm is slow"})
+	flushNewPRs()
+	if len(said["#netbsd-bugs"]) != 0 || len(said["#netbsd-kern"]) != 1 {
+		t.Errorf("announced %v", said)
+	}
+
+	// Nothing is left over for the next round.
+	said = make(map[string][]string)
+	flushNewPRs()
+	if len(said) != 0 {
+		t.Errorf("announced again: %v", said)
+	}
+}
+
+func TestTrackPRSavesChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gnatsirc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateMu.Lock()
+	oldState, oldFile := state, stateFile
+	state, stateFile = newBotState(), filepath.Join(dir, "state.json")
+	stateMu.Unlock()
+	defer func() {
+		stateMu.Lock()
+		state, stateFile = oldState, oldFile
+		stateMu.Unlock()
+	}()
+
+	saved := func() bool {
+		err := os.Remove(filepath.Join(dir, "state.json"))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	pr := PR{Number: 55501, Category: "bin", State: "open", Synopsis: "ls is slow"}
+	trackPR(&pr, false)
+	if !saved() {
+		t.Error("new PR not saved")
+	}
+	again := pr
+	trackPR(&again, false)
+	if saved() {
+		t.Error("saved a lookup that changed nothing")
+	}
+	again.Responsible = "gnats-bugs"
+	trackPR(&again, false)
+	if !saved() {
+		t.Error("changed PR not saved")
+	}
+}
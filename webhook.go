@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+	// Failed deliveries are retried after webhookRetryDelay, doubling up
+	// to webhookMaxDelay, and dropped after webhookMaxAge.
+	webhookRetryDelay = 30 * time.Second
+	webhookMaxDelay   = time.Hour
+	webhookMaxAge     = 24 * time.Hour
+	// How often the queue is checked for deliveries that are due.
+	webhookCheckInterval = 5 * time.Second
+	// The queue is capped so an endpoint that is down for long can't grow
+	// the state file without bound.
+	maxWebhookQueue = 1000
+)
+
+// WebhookConfig is a URL PR events are POSTed to as JSON.
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// Secret signs the body with HMAC-SHA256, sent as
+	// "X-Gnatsirc-Signature: sha256=<hex>".
+	Secret string `json:"secret"`
+	// Events limits deliveries to "new" or "state" events. Empty means
+	// all.
+	Events []string `json:"events"`
+	// Categories limits deliveries to these GNATS categories. Empty
+	// means all.
+	Categories []string `json:"categories"`
+}
+
+// webhookDelivery is a POST waiting to be made. They are kept in the
+// state file, so none are lost over a restart.
+type webhookDelivery struct {
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Kind     string          `json:"kind"`
+	Body     json.RawMessage `json:"body"`
+	Created  time.Time       `json:"created"`
+	Attempts int             `json:"attempts"`
+	NextTry  time.Time       `json:"next_try"`
+}
+
+// webhookPayload is the JSON body of a delivery.
+type webhookPayload struct {
+	ID    string     `json:"id"`
+	Event *prEvent   `json:"event"`
+	PR    exportedPR `json:"pr"`
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// wants reports whether w gets ev.
+func (w *WebhookConfig) wants(ev *prEvent) bool {
+	if len(w.Events) > 0 && !contains(w.Events, ev.Kind) {
+		return false
+	}
+	return len(w.Categories) == 0 || contains(w.Categories, ev.Category)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func findWebhook(url string) *WebhookConfig {
+	for _, w := range getConfig().Webhooks {
+		if w.URL == url {
+			return w
+		}
+	}
+	return nil
+}
+
+// queueWebhooks is the event sink queueing ev for every webhook that wants
+// it.
+func queueWebhooks(ev *prEvent, pr *PR) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	queued := false
+	for _, w := range getConfig().Webhooks {
+		if !w.wants(ev) {
+			continue
+		}
+		id := fmt.Sprintf("%d-%s-%d", ev.Number, ev.Kind, ev.Time.UnixNano())
+		body, err := json.Marshal(&webhookPayload{ID: id, Event: ev, PR: exported(pr)})
+		if err != nil {
+			botLog.Error("Cannot encode webhook payload", "err", err)
+			return
+		}
+		// The queue is in the state file, which a dry run may share
+		// with the real bot.
+		if isDryRun() {
+			announceLog.Info("Dry run, not delivering webhook", "url", w.URL, "id", id, "body", string(body))
+			continue
+		}
+		if len(state.Webhooks) >= maxWebhookQueue {
+			botLog.Warn("Webhook queue full, dropping oldest delivery", "url", state.Webhooks[0].URL, "id", state.Webhooks[0].ID)
+			state.Webhooks = state.Webhooks[1:]
+		}
+		state.Webhooks = append(state.Webhooks, &webhookDelivery{
+			ID:      id,
+			URL:     w.URL,
+			Kind:    ev.Kind,
+			Body:    body,
+			Created: time.Now(),
+		})
+		queued = true
+	}
+	if queued {
+		saveStateLocked()
+	}
+}
+
+// sign returns the signature header value of body.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook makes one delivery attempt.
+func postWebhook(w *WebhookConfig, d *webhookDelivery) error {
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gnatsirc (+"+sourceURL+")")
+	req.Header.Set("X-Gnatsirc-Event", d.Kind)
+	req.Header.Set("X-Gnatsirc-Delivery", d.ID)
+	if w.Secret != "" {
+		req.Header.Set("X-Gnatsirc-Signature", sign(w.Secret, d.Body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// dueWebhooks returns the deliveries to attempt now, dropping those that
+// are too old or whose webhook is no longer configured.
+func dueWebhooks(now time.Time) []*webhookDelivery {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	var due []*webhookDelivery
+	kept := state.Webhooks[:0]
+	for _, d := range state.Webhooks {
+		switch {
+		case findWebhook(d.URL) == nil:
+			botLog.Info("Dropping delivery to removed webhook", "url", d.URL, "id", d.ID)
+		case now.Sub(d.Created) > webhookMaxAge:
+			botLog.Warn("Giving up on webhook delivery", "url", d.URL, "id", d.ID, "attempts", d.Attempts)
+		default:
+			kept = append(kept, d)
+			if !now.Before(d.NextTry) {
+				due = append(due, d)
+			}
+		}
+	}
+	if len(kept) != len(state.Webhooks) {
+		state.Webhooks = kept
+		saveStateLocked()
+	}
+	return due
+}
+
+// finishWebhook removes d from the queue after it was delivered, or
+// schedules the next attempt.
+func finishWebhook(d *webhookDelivery, err error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if err == nil {
+		for i, q := range state.Webhooks {
+			if q == d {
+				state.Webhooks = append(state.Webhooks[:i], state.Webhooks[i+1:]...)
+				break
+			}
+		}
+	} else {
+		d.Attempts++
+		delay := webhookRetryDelay
+		for i := 1; i < d.Attempts && delay < webhookMaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > webhookMaxDelay {
+			delay = webhookMaxDelay
+		}
+		d.NextTry = time.Now().Add(jitter(delay))
+		botLog.Warn("Webhook delivery failed", "url", d.URL, "id", d.ID, "attempts", d.Attempts, "retry_in", delay, "err", err)
+	}
+	saveStateLocked()
+}
+
+// runWebhooks delivers queued webhook events, oldest first.
+func runWebhooks() {
+	for sleep(webhookCheckInterval) {
+		// Deliveries queued when a dry run starts are the real bot's.
+		var due []*webhookDelivery
+		if !isDryRun() {
+			due = dueWebhooks(time.Now())
+		}
+		for _, d := range due {
+			if isStopping() {
+				return
+			}
+			w := findWebhook(d.URL)
+			if w == nil {
+				continue
+			}
+			err := postWebhook(w, d)
+			if err == nil {
+				botLog.Debug("Delivered webhook", "url", d.URL, "id", d.ID)
+			}
+			finishWebhook(d, err)
+		}
+		watcherSucceeded("webhooks")
+	}
+}
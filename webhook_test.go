@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+// withDryRun turns on -dry-run until the returned function is called.
+func withDryRun() func() {
+	old := dryRun
+	on := true
+	dryRun = &on
+	return func() { dryRun = old }
+}
+
+func TestDryRunWebhooks(t *testing.T) {
+	old := getConfig()
+	setConfig(&Config{Webhooks: []*WebhookConfig{{URL: "https://hooks.example.org/gnats"}}})
+	defer setConfig(old)
+	pending := &webhookDelivery{ID: "55500-new-1", URL: "https://hooks.example.org/gnats"}
+	stateMu.Lock()
+	oldState := state
+	state = newBotState()
+	state.Webhooks = []*webhookDelivery{pending}
+	stateMu.Unlock()
+	defer func() {
+		stateMu.Lock()
+		state = oldState
+		stateMu.Unlock()
+	}()
+	defer withDryRun()()
+
+	pr := &PR{Number: 55501, Category: "bin", Synopsis: "ls is slow"}
+	queueWebhooks(&prEvent{Kind: eventNew, Number: pr.Number, Category: pr.Category}, pr)
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if len(state.Webhooks) != 1 || state.Webhooks[0] != pending {
+		t.Errorf("queue changed in a dry run: %+v", state.Webhooks)
+	}
+}